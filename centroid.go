@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+)
+
+// centroidQuery is the body of a POST to /centroid/{count}/json: the URNs
+// to average and, optionally, a weight for each. A URN can also name a
+// work or range, which counts as the mean of its passages.
+type centroidQuery struct {
+	URNs    []string  `json:"urns"`
+	Weights []float64 `json:"weights"`
+}
+
+// contribution tells how much one input passage has in common with a hit:
+// its weighted topic overlap with the hit as a share of all inputs', and
+// its own distance to the hit.
+type contribution struct {
+	URN      string  `json:"urn"`
+	Share    float64 `json:"share"`
+	Distance float64 `json:"distance"`
+}
+
+// weightedCentroid resolves the inputs and averages their vectors by
+// weight. It returns the resolved inputs, their normalized weights and the
+// IDs of all passages they cover.
+func (m *model) weightedCentroid(q centroidQuery) (theta, []theta, []float64, []string, error) {
+	var query theta
+	if len(q.URNs) == 0 {
+		return query, nil, nil, nil, fmt.Errorf("give at least one URN")
+	}
+	weights := q.Weights
+	if weights == nil {
+		weights = make([]float64, len(q.URNs))
+		for i := range weights {
+			weights[i] = 1
+		}
+	}
+	if len(weights) != len(q.URNs) {
+		return query, nil, nil, nil, fmt.Errorf("%d weights for %d URNs", len(weights), len(q.URNs))
+	}
+	var sum float64
+	for _, w := range weights {
+		if w < 0 || math.IsNaN(w) || math.IsInf(w, 0) {
+			return query, nil, nil, nil, fmt.Errorf("weights must be non-negative numbers")
+		}
+		sum += w
+	}
+	if sum == 0 {
+		return query, nil, nil, nil, fmt.Errorf("weights sum to zero")
+	}
+	inputs := make([]theta, len(q.URNs))
+	normed := make([]float64, len(q.URNs))
+	var members []string
+	for i, urn := range q.URNs {
+		t, covered, err := m.resolveQuery(urn)
+		if err != nil {
+			return query, nil, nil, nil, err
+		}
+		if covered == nil {
+			covered = []string{t.ID}
+		}
+		members = append(members, covered...)
+		inputs[i] = t
+		normed[i] = weights[i] / sum
+		if query.Vector == nil {
+			query.Vector = make([]float64, len(t.Vector))
+		}
+		for k := range query.Vector {
+			if k < len(t.Vector) {
+				query.Vector[k] += normed[i] * t.Vector[k]
+			}
+		}
+	}
+	return query, inputs, normed, members, nil
+}
+
+// contributions ranks the inputs by their share in a hit, largest first.
+func contributions(hit theta, inputs []theta, weights []float64, metric DistanceMetric) []contribution {
+	result := make([]contribution, len(inputs))
+	var total float64
+	for i, input := range inputs {
+		var overlap float64
+		for k, v := range input.Vector {
+			if k < len(hit.Vector) {
+				overlap += math.Min(v, hit.Vector[k])
+			}
+		}
+		result[i] = contribution{URN: input.ID, Share: weights[i] * overlap, Distance: metric.Distance(input.Vector, hit.Vector)}
+		total += result[i].Share
+	}
+	for i := range result {
+		if total > 0 {
+			result[i].Share /= total
+		}
+		result[i].Share = math.Round(result[i].Share*1e4) / 1e4
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Share > result[j].Share })
+	return result
+}
+
+// ViewCentroid finds the neighbors of the weighted mean of several passages
+// and tells for each hit which inputs it shares most with. It takes the
+// query options of /view/{urn}/{count}/json except work; excludeSelf=true
+// leaves out the input passages. The centroid itself is not listed.
+func ViewCentroid(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	m, release := modelFromRequest(w, r)
+	defer release()
+	if m == nil {
+		return
+	}
+	info, err := infoFromRequest(m, r)
+	if err == nil && info.Scope != "" {
+		err = fmt.Errorf("work does not apply to centroid queries")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var q centroidQuery
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxVectorQuery))
+	if err == nil {
+		err = json.Unmarshal(body, &q)
+	}
+	if err != nil {
+		http.Error(w, "reading query: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	query, inputs, weights, members, err := m.weightedCentroid(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if info.ExcludeSelf {
+		inInput := map[string]bool{}
+		for _, id := range members {
+			inInput[id] = true
+		}
+		keep := info.Keep
+		info.Keep = func(id string) bool { return !inInput[id] && (keep == nil || keep(id)) }
+	}
+	info.ExcludeSelf = true
+	neighbors, distances := m.searchNear(query, nil, info)
+	result := passageResponse(query, neighbors, distances, info)
+	shares := map[string][]contribution{}
+	for _, hit := range neighbors {
+		shares[hit.ID] = contributions(hit, inputs, weights, info.Metric)
+	}
+	for i := range result.Items {
+		result.Items[i].Contributions = shares[result.Items[i].Id]
+	}
+	resultJSON, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintln(w, string(resultJSON))
+}
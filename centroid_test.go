@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// centroidModel has two passages of urn:cts:x:a.b and one of urn:cts:x:c.d,
+// each entirely about one topic.
+func centroidModel() *model {
+	thetas := []theta{
+		{ID: "urn:cts:x:a.b:1.1", Text: "one", Vector: []float64{1, 0, 0}},
+		{ID: "urn:cts:x:a.b:1.2", Text: "two", Vector: []float64{0, 1, 0}},
+		{ID: "urn:cts:x:c.d:1.1", Text: "three", Vector: []float64{0, 0, 1}},
+	}
+	return &model{store: newMemoryStore(thetas, []string{"t1", "t2", "t3"}), metric: manhattanMetric{}, work: ctsWork}
+}
+
+func TestWeightedCentroid(t *testing.T) {
+	m := centroidModel()
+	cases := []struct {
+		name    string
+		query   centroidQuery
+		vector  []float64
+		weights []float64
+		members []string
+		wantErr bool
+	}{
+		{"equal weights", centroidQuery{URNs: []string{"urn:cts:x:a.b:1.1", "urn:cts:x:a.b:1.2"}},
+			[]float64{0.5, 0.5, 0}, []float64{0.5, 0.5}, []string{"urn:cts:x:a.b:1.1", "urn:cts:x:a.b:1.2"}, false},
+		{"weighted", centroidQuery{URNs: []string{"urn:cts:x:a.b:1.1", "urn:cts:x:a.b:1.2"}, Weights: []float64{3, 1}},
+			[]float64{0.75, 0.25, 0}, []float64{0.75, 0.25}, []string{"urn:cts:x:a.b:1.1", "urn:cts:x:a.b:1.2"}, false},
+		{"zero weight", centroidQuery{URNs: []string{"urn:cts:x:a.b:1.1", "urn:cts:x:c.d:1.1"}, Weights: []float64{0, 2}},
+			[]float64{0, 0, 1}, []float64{0, 1}, []string{"urn:cts:x:a.b:1.1", "urn:cts:x:c.d:1.1"}, false},
+		// A work counts as the mean of its passages, and covers all of them.
+		{"work", centroidQuery{URNs: []string{"urn:cts:x:a.b", "urn:cts:x:c.d:1.1"}},
+			[]float64{0.25, 0.25, 0.5}, []float64{0.5, 0.5}, []string{"urn:cts:x:a.b:1.1", "urn:cts:x:a.b:1.2", "urn:cts:x:c.d:1.1"}, false},
+		{"no URNs", centroidQuery{}, nil, nil, nil, true},
+		{"too few weights", centroidQuery{URNs: []string{"urn:cts:x:a.b:1.1", "urn:cts:x:a.b:1.2"}, Weights: []float64{1}}, nil, nil, nil, true},
+		{"negative weight", centroidQuery{URNs: []string{"urn:cts:x:a.b:1.1"}, Weights: []float64{-1}}, nil, nil, nil, true},
+		{"weight not a number", centroidQuery{URNs: []string{"urn:cts:x:a.b:1.1"}, Weights: []float64{math.NaN()}}, nil, nil, nil, true},
+		{"weights sum to zero", centroidQuery{URNs: []string{"urn:cts:x:a.b:1.1"}, Weights: []float64{0}}, nil, nil, nil, true},
+		{"unknown URN", centroidQuery{URNs: []string{"urn:cts:x:a.b:1.1", "urn:cts:x:e.f:1.1"}}, nil, nil, nil, true},
+	}
+	for _, c := range cases {
+		query, inputs, weights, members, err := m.weightedCentroid(c.query)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: error %v, want error %v", c.name, err, c.wantErr)
+			continue
+		}
+		if c.wantErr {
+			continue
+		}
+		for k := range c.vector {
+			if math.Abs(query.Vector[k]-c.vector[k]) > 1e-12 {
+				t.Errorf("%s: centroid %v, want %v", c.name, query.Vector, c.vector)
+				break
+			}
+		}
+		if len(inputs) != len(c.query.URNs) || inputs[0].ID != c.query.URNs[0] {
+			t.Errorf("%s: inputs %+v", c.name, inputs)
+		}
+		if !reflect.DeepEqual(weights, c.weights) {
+			t.Errorf("%s: weights %v, want %v", c.name, weights, c.weights)
+		}
+		if !reflect.DeepEqual(members, c.members) {
+			t.Errorf("%s: members %v, want %v", c.name, members, c.members)
+		}
+	}
+}
+
+// Each input's share in a hit is its weighted topic overlap with the hit,
+// as part of all inputs' overlap.
+func TestContributions(t *testing.T) {
+	inputs := []theta{
+		{ID: "a", Vector: []float64{1, 0, 0}},
+		{ID: "c", Vector: []float64{0, 0, 1}},
+		{ID: "b", Vector: []float64{0, 1, 0}},
+	}
+	hit := theta{ID: "hit", Vector: []float64{0.5, 0.5, 0}}
+	got := contributions(hit, inputs, []float64{0.5, 0.25, 0.25}, manhattanMetric{})
+	want := []contribution{{"a", 0.6667, 1}, {"b", 0.3333, 1}, {"c", 0, 2}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("contributions %+v, want %+v", got, want)
+	}
+
+	// Equal shares keep the input order; no overlap at all gives shares of
+	// zero rather than NaN.
+	got = contributions(theta{Vector: []float64{0, 0, 1}}, inputs[:1], []float64{1}, manhattanMetric{})
+	if got[0].Share != 0 {
+		t.Errorf("no overlap gave a share of %v", got[0].Share)
+	}
+	got = contributions(hit, []theta{inputs[0], inputs[2]}, []float64{0.5, 0.5}, manhattanMetric{})
+	if got[0].URN != "a" || got[0].Share != 0.5 || got[1].Share != 0.5 {
+		t.Errorf("equal shares %+v", got)
+	}
+}
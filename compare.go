@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// overlap measures how much two neighbor lists for the same passage agree.
+type overlap struct {
+	Shared  int     `json:"shared"`
+	Jaccard float64 `json:"jaccard"`
+	RBO     float64 `json:"rbo"`
+	// KendallTau compares the order of the shared items; it is missing
+	// when fewer than two items are shared.
+	KendallTau *float64 `json:"kendallTau"`
+}
+
+type modelComparison struct {
+	URN     string              `json:"urn"`
+	Count   int                 `json:"count"`
+	Models  []string            `json:"models"`
+	A       PassageJsonResponse `json:"a"`
+	B       PassageJsonResponse `json:"b"`
+	Overlap overlap             `json:"overlap"`
+}
+
+// compareSummary averages the overlap statistics over every passage the
+// two models have in common.
+type compareSummary struct {
+	Models         []string `json:"models"`
+	Count          int      `json:"count"`
+	RBOPersistence float64  `json:"rboPersistence"`
+	Passages       int      `json:"passages"`
+	Missing        int      `json:"missing"`
+	MeanShared     float64  `json:"meanShared"`
+	MeanJaccard    float64  `json:"meanJaccard"`
+	MeanRBO        float64  `json:"meanRBO"`
+	MeanKendallTau float64  `json:"meanKendallTau"`
+	TauPassages    int      `json:"tauPassages"`
+}
+
+// compareNeighbors computes the overlap statistics of two ranked ID lists.
+func compareNeighbors(a, b []string, p float64) overlap {
+	return overlap{
+		Shared:     len(intersect(a, b)),
+		Jaccard:    jaccard(a, b),
+		RBO:        rankBiasedOverlap(a, b, p),
+		KendallTau: kendallTau(a, b),
+	}
+}
+
+func intersect(a, b []string) []string {
+	inB := map[string]bool{}
+	for _, id := range b {
+		inB[id] = true
+	}
+	var shared []string
+	for _, id := range a {
+		if inB[id] {
+			shared = append(shared, id)
+		}
+	}
+	return shared
+}
+
+// jaccard is |A ∩ B| / |A ∪ B|.
+func jaccard(a, b []string) float64 {
+	shared := len(intersect(a, b))
+	union := len(a) + len(b) - shared
+	if union == 0 {
+		return 1
+	}
+	return float64(shared) / float64(union)
+}
+
+// rankBiasedOverlap is the extrapolated RBO of Webber, Moffat and Zobel
+// (2010) at the depth of the shorter list. p close to 1 weighs deep ranks
+// almost like top ranks; smaller p concentrates on the top.
+func rankBiasedOverlap(a, b []string, p float64) float64 {
+	k := len(a)
+	if len(b) < k {
+		k = len(b)
+	}
+	if k == 0 {
+		return 0
+	}
+	seenA, seenB := map[string]bool{}, map[string]bool{}
+	shared := 0
+	sum := 0.0
+	weight := 1.0
+	for d := 1; d <= k; d++ {
+		x, y := a[d-1], b[d-1]
+		if x == y {
+			shared++
+		} else {
+			if seenB[x] {
+				shared++
+			}
+			if seenA[y] {
+				shared++
+			}
+		}
+		seenA[x], seenB[y] = true, true
+		weight *= p
+		sum += float64(shared) / float64(d) * weight
+	}
+	return float64(shared)/float64(k)*weight + (1-p)/p*sum
+}
+
+// kendallTau compares the relative order of the items both lists share.
+func kendallTau(a, b []string) *float64 {
+	rankB := map[string]int{}
+	for i, id := range b {
+		rankB[id] = i
+	}
+	var ranks []int
+	for _, id := range a {
+		if r, ok := rankB[id]; ok {
+			ranks = append(ranks, r)
+		}
+	}
+	n := len(ranks)
+	if n < 2 {
+		return nil
+	}
+	concordant, discordant := 0, 0
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			if ranks[i] < ranks[j] {
+				concordant++
+			} else {
+				discordant++
+			}
+		}
+	}
+	tau := float64(concordant-discordant) / float64(n*(n-1)/2)
+	return &tau
+}
+
+// neighborIDs returns the IDs of the count nearest neighbors of a passage,
+// leaving out the passage itself.
+func (m *model) neighborIDs(query theta, info Info) []string {
+	thetas, _ := m.nearestNeighbors(query, info)
+	var ids []string
+	for _, t := range thetas {
+		if t.ID != query.ID && len(ids) < info.Count {
+			ids = append(ids, t.ID)
+		}
+	}
+	return ids
+}
+
+// comparisonRequest holds what CompareModels and CompareSummary share:
+// the two models, the neighbor count and the RBO persistence.
+func comparisonRequest(w http.ResponseWriter, r *http.Request) ([]*model, func(), int, float64, bool) {
+	vars := mux.Vars(r)
+	names := []string{vars["a"], vars["b"]}
+	count, err := strconv.Atoi(vars["count"])
+	if err != nil || count <= 0 {
+		http.Error(w, "count must be a positive number", http.StatusBadRequest)
+		return nil, nil, 0, 0, false
+	}
+	p := 0.9
+	if v := r.URL.Query().Get("p"); v != "" {
+		p, err = strconv.ParseFloat(v, 64)
+		if err != nil || p <= 0 || p >= 1 {
+			http.Error(w, "p must be between 0 and 1", http.StatusBadRequest)
+			return nil, nil, 0, 0, false
+		}
+	}
+	pair, release, err := acquireModels(names...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil, nil, 0, 0, false
+	}
+	return pair, release, count, p, true
+}
+
+// metricsFromRequest resolves ?metric= for each model; without it, each
+// model uses its own default.
+func metricsFromRequest(pair []*model, r *http.Request) ([]DistanceMetric, error) {
+	result := make([]DistanceMetric, len(pair))
+	for i, m := range pair {
+		metric, err := m.metricFromRequest(r)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = metric
+	}
+	return result, nil
+}
+
+// CompareModels returns the neighbors of one passage in two models along
+// with their overlap.
+func CompareModels(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	pair, release, count, p, ok := comparisonRequest(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+	urn := mux.Vars(r)["urn"]
+	var lists [2][]string
+	var responses [2]PassageJsonResponse
+	for i, m := range pair {
+		info, err := infoFromRequest(m, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		info.Order = ""
+		responses[i], err = JsonResponse(m, info)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("model %s: %v", m.config.Name, err), http.StatusNotFound)
+			return
+		}
+		for _, item := range responses[i].Items {
+			if item.Rank > 0 && len(lists[i]) < count {
+				lists[i] = append(lists[i], item.Id)
+			}
+		}
+	}
+	result := modelComparison{
+		URN:     urn,
+		Count:   count,
+		Models:  []string{pair[0].config.Name, pair[1].config.Name},
+		A:       responses[0],
+		B:       responses[1],
+		Overlap: compareNeighbors(lists[0], lists[1], p),
+	}
+	resultJSON, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintln(w, string(resultJSON))
+}
+
+// CompareSummary starts a job that compares the neighborhoods of all
+// passages of the first model with those in the second.
+func CompareSummary(w http.ResponseWriter, r *http.Request) {
+	pair, release, count, p, ok := comparisonRequest(w, r)
+	if !ok {
+		return
+	}
+	metrics, err := metricsFromRequest(pair, r)
+	if err != nil {
+		release()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	exact := r.URL.Query().Get("exact") == "true"
+	j := startJob("compare", pair[0].store.Count(), func(ctx context.Context, j *job) (interface{}, error) {
+		defer release()
+		return summarizeComparison(ctx, j, pair, metrics, count, p, exact)
+	})
+	writeJobAccepted(w, j)
+}
+
+func summarizeComparison(ctx context.Context, j *job, pair []*model, metrics []DistanceMetric, count int, p float64, exact bool) (*compareSummary, error) {
+	a, b := pair[0], pair[1]
+	summary := &compareSummary{
+		Models:         []string{a.config.Name, b.config.Name},
+		Count:          count,
+		RBOPersistence: p,
+	}
+	var ids []string
+	a.store.Vectors(func(id string, vector []float64) error {
+		ids = append(ids, id)
+		return nil
+	})
+	sort.Strings(ids)
+
+	var mu sync.Mutex
+	var sumShared, sumJaccard, sumRBO, sumTau float64
+	err := parallelEach(ctx, j, ids, func(id string) {
+		qa, errA := a.store.Get(id)
+		qb, errB := b.store.Get(id)
+		if errA != nil || errB != nil {
+			mu.Lock()
+			summary.Missing++
+			mu.Unlock()
+			return
+		}
+		o := compareNeighbors(
+			a.neighborIDs(qa, Info{URN: id, Count: count, Metric: metrics[0], Exact: exact}),
+			b.neighborIDs(qb, Info{URN: id, Count: count, Metric: metrics[1], Exact: exact}),
+			p)
+		mu.Lock()
+		defer mu.Unlock()
+		summary.Passages++
+		sumShared += float64(o.Shared)
+		sumJaccard += o.Jaccard
+		sumRBO += o.RBO
+		if o.KendallTau != nil {
+			summary.TauPassages++
+			sumTau += *o.KendallTau
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if summary.Passages > 0 {
+		n := float64(summary.Passages)
+		summary.MeanShared = sumShared / n
+		summary.MeanJaccard = sumJaccard / n
+		summary.MeanRBO = sumRBO / n
+	}
+	if summary.TauPassages > 0 {
+		summary.MeanKendallTau = sumTau / float64(summary.TauPassages)
+	}
+	return summary, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRankBiasedOverlap(t *testing.T) {
+	cases := []struct {
+		a, b []string
+		want float64
+	}{
+		{[]string{"a", "b", "c"}, []string{"a", "b", "c"}, 1},
+		{[]string{"a", "b", "c"}, []string{"x", "y", "z"}, 0},
+		{[]string{"a", "b"}, []string{"b", "a"}, 0.9}, // 0.81 + 0.1/0.9 * 0.81
+		{nil, []string{"a"}, 0},
+	}
+	for _, c := range cases {
+		if got := rankBiasedOverlap(c.a, c.b, 0.9); math.Abs(got-c.want) > 1e-9 {
+			t.Errorf("rankBiasedOverlap(%v, %v) = %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+	// Agreement at the top counts for more than agreement further down.
+	top := rankBiasedOverlap([]string{"a", "b", "c"}, []string{"a", "c", "b"}, 0.9)
+	bottom := rankBiasedOverlap([]string{"a", "b", "c"}, []string{"b", "a", "c"}, 0.9)
+	if top <= bottom {
+		t.Errorf("swapping ranks 2 and 3 gave %v, swapping 1 and 2 gave %v", top, bottom)
+	}
+}
+
+func TestKendallTau(t *testing.T) {
+	cases := []struct {
+		a, b []string
+		want float64
+	}{
+		{[]string{"a", "b", "c"}, []string{"a", "b", "c"}, 1},
+		{[]string{"a", "b", "c"}, []string{"c", "b", "a"}, -1},
+		{[]string{"a", "b", "c"}, []string{"c", "a", "b"}, -1.0 / 3},
+		{[]string{"a", "x", "b"}, []string{"a", "b", "y"}, 1}, // only shared items count
+	}
+	for _, c := range cases {
+		got := kendallTau(c.a, c.b)
+		if got == nil || math.Abs(*got-c.want) > 1e-9 {
+			t.Errorf("kendallTau(%v, %v) = %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+	if got := kendallTau([]string{"a", "b"}, []string{"a", "c"}); got != nil {
+		t.Errorf("kendallTau with one shared item = %v, want nil", *got)
+	}
+}
+
+func TestJaccard(t *testing.T) {
+	if got := jaccard([]string{"a", "b", "c"}, []string{"b", "c", "d"}); got != 0.5 {
+		t.Errorf("jaccard = %v, want 0.5", got)
+	}
+	if got := jaccard(nil, nil); got != 1 {
+		t.Errorf("jaccard of two empty lists = %v, want 1", got)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// DistanceMetric compares two topic vectors. Smaller values mean more
+// similar passages; identical vectors have a distance of 0.
+type DistanceMetric interface {
+	Name() string
+	Distance(x, y []float64) float64
+}
+
+// smoothing keeps logarithms finite when a topic has zero mass.
+const smoothing = 1e-10
+
+var metrics = map[string]DistanceMetric{
+	"jsd":                jsdMetric{},
+	"manhattan":          manhattanMetric{},
+	"manhattan_weighted": weightedManhattanMetric{},
+	"hellinger":          hellingerMetric{},
+	"cosine":             cosineMetric{},
+	"euclidean":          euclideanMetric{},
+	"bhattacharyya":      bhattacharyyaMetric{},
+	"skl":                symmetricKLMetric{},
+	"wasserstein":        wassersteinMetric{},
+}
+
+// lookupMetric resolves a metric name for this model; the weighted
+// Manhattan metric takes its weights from the model's configuration.
+func (m *model) lookupMetric(name string) (DistanceMetric, error) {
+	metric, ok := metrics[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown metric %q (available: %s)", name, strings.Join(metricNames(), ", "))
+	}
+	if _, ok := metric.(weightedManhattanMetric); ok {
+		metric = weightedManhattanMetric{weights: m.config.Weights}
+	}
+	return metric, nil
+}
+
+func metricNames() []string {
+	var names []string
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// configuredMetric resolves the metric named in config.json. Anything
+// unknown falls back to Manhattan, which has always been the default.
+func (m *model) configuredMetric() DistanceMetric {
+	if m.config.Distance == "" {
+		return manhattanMetric{}
+	}
+	metric, err := m.lookupMetric(m.config.Distance)
+	if err != nil {
+		log.Println(err, "- falling back to manhattan")
+		return manhattanMetric{}
+	}
+	return metric
+}
+
+// metricFromRequest honours an optional ?metric= query parameter and the
+// ?mask= and ?merge= topic options.
+func (m *model) metricFromRequest(r *http.Request) (DistanceMetric, error) {
+	name := r.URL.Query().Get("metric")
+	projection, err := m.projectionFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" && projection == m.projection {
+		return m.metric, nil
+	}
+	metric := m.configuredMetric()
+	if name != "" {
+		if metric, err = m.lookupMetric(name); err != nil {
+			return nil, err
+		}
+	}
+	return m.projectMetric(metric, projection), nil
+}
+
+type jsdMetric struct{}
+
+func (jsdMetric) Name() string                    { return "jsd" }
+func (jsdMetric) Distance(x, y []float64) float64 { return jensenShannon(x, y) }
+
+type manhattanMetric struct{}
+
+func (manhattanMetric) Name() string                    { return "manhattan" }
+func (manhattanMetric) Distance(x, y []float64) float64 { return manhattan(x, y) }
+
+type weightedManhattanMetric struct {
+	weights []float64
+}
+
+func (weightedManhattanMetric) Name() string { return "manhattan_weighted" }
+
+// Distance weighs each topic by the configured "weights"; topics without a
+// weight count fully.
+func (m weightedManhattanMetric) Distance(x, y []float64) float64 {
+	weights := m.weights
+	if len(weights) < len(x) {
+		weights = make([]float64, len(x))
+		for i := range weights {
+			weights[i] = 1
+			if i < len(m.weights) {
+				weights[i] = m.weights[i]
+			}
+		}
+	}
+	return manhattan_wghted(x, y, weights)
+}
+
+type hellingerMetric struct{}
+
+func (hellingerMetric) Name() string { return "hellinger" }
+func (hellingerMetric) Distance(x, y []float64) float64 {
+	var sum float64
+	for i := range x {
+		d := math.Sqrt(x[i]) - math.Sqrt(y[i])
+		sum += d * d
+	}
+	return math.Sqrt(sum) / math.Sqrt2
+}
+
+type cosineMetric struct{}
+
+func (cosineMetric) Name() string { return "cosine" }
+func (cosineMetric) Distance(x, y []float64) float64 {
+	var dot, nx, ny float64
+	for i := range x {
+		dot += x[i] * y[i]
+		nx += x[i] * x[i]
+		ny += y[i] * y[i]
+	}
+	if nx == 0 || ny == 0 {
+		return 1
+	}
+	return 1 - dot/(math.Sqrt(nx)*math.Sqrt(ny))
+}
+
+type euclideanMetric struct{}
+
+func (euclideanMetric) Name() string { return "euclidean" }
+func (euclideanMetric) Distance(x, y []float64) float64 {
+	var sum float64
+	for i := range x {
+		d := x[i] - y[i]
+		sum += d * d
+	}
+	return math.Sqrt(sum)
+}
+
+type bhattacharyyaMetric struct{}
+
+func (bhattacharyyaMetric) Name() string { return "bhattacharyya" }
+func (bhattacharyyaMetric) Distance(x, y []float64) float64 {
+	var bc float64
+	for i := range x {
+		bc += math.Sqrt(x[i] * y[i])
+	}
+	return -math.Log(math.Max(bc, smoothing))
+}
+
+type symmetricKLMetric struct{}
+
+func (symmetricKLMetric) Name() string { return "skl" }
+func (symmetricKLMetric) Distance(x, y []float64) float64 {
+	var result float64
+	for i := range x {
+		p := x[i] + smoothing
+		q := y[i] + smoothing
+		result += (p - q) * (math.Log(p) - math.Log(q))
+	}
+	return result
+}
+
+// wassersteinMetric is the earth mover's distance with topics laid out in
+// their model order, one unit apart.
+type wassersteinMetric struct{}
+
+func (wassersteinMetric) Name() string { return "wasserstein" }
+func (wassersteinMetric) Distance(x, y []float64) float64 {
+	var result, cx, cy float64
+	for i := range x {
+		cx += x[i]
+		cy += y[i]
+		result += mpair(cx, cy)
+	}
+	return result
+}
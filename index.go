@@ -0,0 +1,229 @@
+package main
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// metricSpace is implemented by distance metrics that are a monotone
+// transform of a true metric. The vantage-point index prunes with the
+// triangle inequality in that space, so rankings match the plain distance.
+type metricSpace interface {
+	DistanceMetric
+	spaceDistance(x, y []float64) float64
+}
+
+func (jsdMetric) spaceDistance(x, y []float64) float64 {
+	return math.Sqrt(math.Max(jensenShannon(x, y), 0))
+}
+
+func (m hellingerMetric) spaceDistance(x, y []float64) float64   { return m.Distance(x, y) }
+func (m manhattanMetric) spaceDistance(x, y []float64) float64   { return m.Distance(x, y) }
+func (m euclideanMetric) spaceDistance(x, y []float64) float64   { return m.Distance(x, y) }
+func (m wassersteinMetric) spaceDistance(x, y []float64) float64 { return m.Distance(x, y) }
+
+func (m weightedManhattanMetric) spaceDistance(x, y []float64) float64 { return m.Distance(x, y) }
+
+type vpNode struct {
+	item    int
+	radius  float64
+	inside  *vpNode
+	outside *vpNode
+}
+
+// vpTree is a vantage-point tree over the theta vectors. Searches are exact
+// unless a slack > 0 is given, in which case branches that can only improve
+// the current k-th distance by less than that factor are skipped.
+//
+// Under a topic projection the tree is built over the projected vectors
+// (points) with the metric inside the projection, and queries are
+// projected before the search; items keep the stored vectors.
+type vpTree struct {
+	metric     metricSpace
+	answers    DistanceMetric // the metric searches rank by, projection included
+	projection *topicProjection
+	items      []theta
+	points     [][]float64
+	root       *vpNode
+	slack      float64
+}
+
+func buildVPTree(items []theta, points [][]float64, metric metricSpace, slack float64) *vpTree {
+	t := &vpTree{metric: metric, answers: metric, items: items, points: points, slack: slack}
+	if t.points == nil {
+		t.points = make([][]float64, len(items))
+		for i, item := range items {
+			t.points[i] = item.Vector
+		}
+	}
+	order := make([]int, len(items))
+	for i := range order {
+		order[i] = i
+	}
+	rnd := rand.New(rand.NewSource(1))
+	t.root = t.build(order, rnd)
+	return t
+}
+
+func (t *vpTree) build(order []int, rnd *rand.Rand) *vpNode {
+	if len(order) == 0 {
+		return nil
+	}
+	pick := rnd.Intn(len(order))
+	order[0], order[pick] = order[pick], order[0]
+	node := &vpNode{item: order[0]}
+	rest := order[1:]
+	if len(rest) == 0 {
+		return node
+	}
+	vantage := t.points[node.item]
+	dists := make([]float64, len(rest))
+	for i, item := range rest {
+		dists[i] = t.metric.spaceDistance(vantage, t.points[item])
+	}
+	sort.Sort(byDistance{order: rest, dists: dists})
+	median := len(rest) / 2
+	node.radius = dists[median]
+	node.inside = t.build(rest[:median], rnd)
+	node.outside = t.build(rest[median:], rnd)
+	return node
+}
+
+type byDistance struct {
+	order []int
+	dists []float64
+}
+
+func (b byDistance) Len() int           { return len(b.order) }
+func (b byDistance) Less(i, j int) bool { return b.dists[i] < b.dists[j] }
+func (b byDistance) Swap(i, j int) {
+	b.order[i], b.order[j] = b.order[j], b.order[i]
+	b.dists[i], b.dists[j] = b.dists[j], b.dists[i]
+}
+
+// search returns the k items closest to query, nearest first, together
+// with their distances under the metric the index answers for.
+func (t *vpTree) search(query []float64, k int) ([]theta, []float64) {
+	if k <= 0 {
+		return nil, nil
+	}
+	point := query
+	if t.projection != nil {
+		point = t.projection.project(query)
+	}
+	best := newTopK(k, false)
+	tau := func() float64 {
+		if !best.Full() {
+			return math.Inf(1)
+		}
+		return best.Worst() / (1 + t.slack)
+	}
+	var visit func(n *vpNode)
+	visit = func(n *vpNode) {
+		if n == nil {
+			return
+		}
+		d := t.metric.spaceDistance(point, t.points[n.item])
+		best.Offer(t.items[n.item], d)
+		if d < n.radius {
+			visit(n.inside)
+			if d+tau() >= n.radius {
+				visit(n.outside)
+			}
+		} else {
+			visit(n.outside)
+			if d-tau() <= n.radius {
+				visit(n.inside)
+			}
+		}
+	}
+	visit(t.root)
+
+	items, distances := best.Sorted()
+	for i := range items {
+		distances[i] = t.answers.Distance(query, items[i].Vector)
+	}
+	return items, distances
+}
+
+// buildIndex indexes all stored vectors for the default metric, provided
+// that metric supports it.
+func (m *model) buildIndex() {
+	metric := m.metric
+	var projection *topicProjection
+	if pm, ok := metric.(projectedMetric); ok {
+		metric, projection = pm.metric, pm.projection
+	}
+	space, ok := metric.(metricSpace)
+	if !ok {
+		log.Println("Metric", m.metric.Name(), "cannot be indexed; using exact scans.")
+		return
+	}
+	start := time.Now()
+	var items []theta
+	var points [][]float64
+	m.store.Vectors(func(id string, vector []float64) error {
+		items = append(items, theta{ID: id, Vector: vector})
+		if projection != nil {
+			points = append(points, projection.stored(id, vector, nil))
+		}
+		return nil
+	})
+	m.index = buildVPTree(items, points, space, m.config.IndexSlack)
+	m.index.answers, m.index.projection = m.metric, projection
+	log.Printf("Indexed %d passages for %s in %v.", len(items), m.metric.Name(), time.Since(start))
+}
+
+// nearestNeighbors answers a neighbor query from the index when it covers
+// the requested metric and falls back to calculateDistance otherwise, as
+// well as for queries that restrict the neighbors.
+func (m *model) nearestNeighbors(query theta, info Info) ([]theta, []float64) {
+	if m.index == nil || info.Exact || info.Keep != nil || info.MinDistance > 0 || m.index.answers.Name() != info.Metric.Name() {
+		return m.calculateDistance(query, info)
+	}
+	thetas, distances := m.index.search(query.Vector, info.Count+1)
+	return m.withTexts(thetas), distances
+}
+
+// verifyIndex compares index results against exact scans for a sample of
+// stored passages and logs the mean recall.
+func (m *model) verifyIndex(samples, count int) {
+	if m.index == nil || samples <= 0 || len(m.index.items) == 0 {
+		return
+	}
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var recall float64
+	var indexTime, scanTime time.Duration
+	for s := 0; s < samples; s++ {
+		item := m.index.items[rnd.Intn(len(m.index.items))]
+		query := theta{ID: item.ID, Vector: item.Vector}
+
+		start := time.Now()
+		approx, _ := m.index.search(query.Vector, count)
+		indexTime += time.Since(start)
+
+		start = time.Now()
+		exact, _ := m.calculateDistance(query, Info{Count: count - 1, Metric: m.index.answers})
+		scanTime += time.Since(start)
+
+		want := map[string]bool{}
+		for _, t := range exact {
+			want[t.ID] = true
+		}
+		hits := 0
+		for _, a := range approx {
+			if want[a.ID] {
+				hits++
+			}
+		}
+		if len(want) > 0 {
+			recall += float64(hits) / float64(len(want))
+		}
+	}
+	log.Printf("Index recall@%d over %d queries: %.4f (index %v, scan %v per query)",
+		count, samples, recall/float64(samples),
+		indexTime/time.Duration(samples), scanTime/time.Duration(samples))
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func randomThetas(n, k int, seed int64) []theta {
+	rnd := rand.New(rand.NewSource(seed))
+	thetas := make([]theta, n)
+	for i := range thetas {
+		vector := make([]float64, k)
+		for j := range vector {
+			vector[j] = rnd.ExpFloat64()
+		}
+		thetas[i] = theta{ID: strconv.Itoa(i), Vector: normalized(vector)}
+	}
+	return thetas
+}
+
+// An exact index (slack 0) finds the same neighbors, at the same distances,
+// as a full scan for every metric it can index.
+func TestIndexMatchesScan(t *testing.T) {
+	thetas := randomThetas(300, 8, 1)
+	metrics := []DistanceMetric{
+		jsdMetric{}, hellingerMetric{}, manhattanMetric{}, euclideanMetric{}, wassersteinMetric{},
+		weightedManhattanMetric{weights: []float64{1, 2, 1, 0.5, 1, 3, 1, 1}},
+	}
+	for _, metric := range metrics {
+		m := &model{store: newMemoryStore(thetas, make([]string, 8)), metric: metric}
+		m.buildIndex()
+		if m.index == nil {
+			t.Errorf("%s: not indexed", metric.Name())
+			continue
+		}
+		for _, query := range thetas[:30] {
+			info := Info{Count: 10, Metric: metric}
+			indexed, indexDistances := m.nearestNeighbors(query, info)
+			scanned, scanDistances := m.calculateDistance(query, info)
+			if len(indexed) != len(scanned) {
+				t.Fatalf("%s: index found %d, scan %d", metric.Name(), len(indexed), len(scanned))
+			}
+			for i := range scanned {
+				if indexed[i].ID != scanned[i].ID || math.Abs(indexDistances[i]-scanDistances[i]) > 1e-12 {
+					t.Fatalf("%s query %s rank %d: index %s at %v, scan %s at %v", metric.Name(), query.ID, i,
+						indexed[i].ID, indexDistances[i], scanned[i].ID, scanDistances[i])
+				}
+			}
+		}
+	}
+}
+
+// Queries the index cannot answer, such as with a minimum distance or
+// an unindexed metric, fall back to the scan.
+func TestIndexFallback(t *testing.T) {
+	thetas := randomThetas(50, 4, 2)
+	m := &model{store: newMemoryStore(thetas, make([]string, 4)), metric: jsdMetric{}}
+	m.buildIndex()
+	query := thetas[0]
+	near, _ := m.nearestNeighbors(query, Info{Count: 3, Metric: jsdMetric{}})
+	far, distances := m.nearestNeighbors(query, Info{Count: 3, Metric: jsdMetric{}, MinDistance: 0.05})
+	if near[0].ID != query.ID {
+		t.Errorf("nearest to %s is %s", query.ID, near[0].ID)
+	}
+	for i, d := range distances {
+		if d < 0.05 {
+			t.Errorf("minDistance 0.05 returned %s at %v", far[i].ID, d)
+		}
+	}
+	cosine, _ := m.nearestNeighbors(query, Info{Count: 3, Metric: cosineMetric{}})
+	exact, _ := m.calculateDistance(query, Info{Count: 3, Metric: cosineMetric{}})
+	for i := range exact {
+		if cosine[i].ID != exact[i].ID {
+			t.Errorf("cosine rank %d: %s, want %s", i, cosine[i].ID, exact[i].ID)
+		}
+	}
+}
+
+func TestVerifyIndexEmpty(t *testing.T) {
+	m := &model{store: newMemoryStore(nil, make([]string, 4)), metric: jsdMetric{}}
+	m.buildIndex()
+	m.verifyIndex(10, 10) // must not panic
+	if thetas, _ := m.nearestNeighbors(theta{Vector: []float64{1, 0, 0, 0}}, Info{Count: 3, Metric: jsdMetric{}}); len(thetas) != 0 {
+		t.Errorf("an empty index found %v", thetas)
+	}
+}
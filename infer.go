@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"strings"
+)
+
+// Fold-in methods for /infer.
+const (
+	inferGibbs       = "gibbs"       // collapsed Gibbs sampling, topic-words fixed
+	inferVariational = "variational" // EM on the passage's topic proportions
+)
+
+// inferQuery is the body of a POST to /infer/{count}/json: a text, split on
+// whitespace, or its tokens, and optionally how to infer its topics.
+type inferQuery struct {
+	Text       string   `json:"text"`
+	Tokens     []string `json:"tokens"`
+	Method     string   `json:"method"`
+	Iterations int      `json:"iterations"`
+	BurnIn     int      `json:"burnIn"`
+	Seed       int64    `json:"seed"`
+}
+
+// inferResponse is a PassageJsonResponse with the inferred topic vector and
+// how many tokens the model knew.
+type inferResponse struct {
+	PassageJsonResponse
+	Method string    `json:"method"`
+	Tokens int       `json:"tokens"`
+	Known  int       `json:"known"`
+	Theta  []float64 `json:"theta"`
+}
+
+// tokens are the tokens of the query: Tokens as given, or else the Text
+// split on whitespace.
+func (q inferQuery) tokens() []string {
+	if q.Tokens != nil {
+		return q.Tokens
+	}
+	return strings.Fields(q.Text)
+}
+
+// maxInferQuery bounds the size of an inference request body.
+const maxInferQuery = 16 << 20
+
+// inferAlpha is the symmetric Dirichlet prior on topic proportions; unset,
+// it is 5 spread over all topics, MALLET's default.
+func (m *model) inferAlpha() float64 {
+	if m.config.InferAlpha > 0 {
+		return m.config.InferAlpha
+	}
+	return 5 / float64(len(m.store.Topics()))
+}
+
+// infer folds a text into the model: it estimates the text's topic
+// proportions while keeping the topic-word distributions fixed. Tokens not
+// in the vocabulary are ignored; known counts the rest.
+func (m *model) infer(q inferQuery) (vector []float64, known int, err error) {
+	tokens := q.tokens()
+	var words []int
+	for _, token := range tokens {
+		if w, ok := m.words.lookup(token); ok {
+			words = append(words, w)
+		}
+	}
+	if len(words) == 0 {
+		return nil, 0, fmt.Errorf("none of the %d tokens are in the model's vocabulary", len(tokens))
+	}
+	iterations := q.Iterations
+	if iterations <= 0 {
+		iterations = 100
+	}
+	switch strings.ToLower(q.Method) {
+	case "", inferGibbs:
+		burnIn := q.BurnIn
+		if burnIn <= 0 || burnIn >= iterations {
+			burnIn = iterations / 2
+		}
+		vector = m.foldInGibbs(words, iterations, burnIn, q.Seed)
+	case inferVariational:
+		vector = m.foldInEM(words, iterations)
+	default:
+		return nil, 0, fmt.Errorf("method must be %s or %s", inferGibbs, inferVariational)
+	}
+	return vector, len(words), nil
+}
+
+// foldInGibbs samples a topic for each token given the others and averages
+// the passage's topic proportions over the samples after burn-in.
+func (m *model) foldInGibbs(words []int, iterations, burnIn int, seed int64) []float64 {
+	k := len(m.store.Topics())
+	alpha := m.inferAlpha()
+	rnd := rand.New(rand.NewSource(seed))
+	counts := make([]float64, k)
+	assigned := make([]int, len(words))
+	for i := range words {
+		assigned[i] = rnd.Intn(k)
+		counts[assigned[i]]++
+	}
+	p := make([]float64, k)
+	sum := make([]float64, k)
+	for it := 0; it < iterations; it++ {
+		for i, w := range words {
+			counts[assigned[i]]--
+			var total float64
+			for t := range p {
+				total += (counts[t] + alpha) * m.words.phi(w, t)
+				p[t] = total
+			}
+			u := rnd.Float64() * total
+			t := 0
+			for t < k-1 && p[t] <= u {
+				t++
+			}
+			assigned[i] = t
+			counts[t]++
+		}
+		if it >= burnIn {
+			for t := range sum {
+				sum[t] += counts[t] + alpha
+			}
+		}
+	}
+	return normalized(sum)
+}
+
+// foldInEM alternates between the topic responsibilities of each token and
+// the passage's topic proportions until these settle.
+func (m *model) foldInEM(words []int, iterations int) []float64 {
+	k := len(m.store.Topics())
+	alpha := m.inferAlpha()
+	vector := make([]float64, k)
+	for t := range vector {
+		vector[t] = 1 / float64(k)
+	}
+	expected := make([]float64, k)
+	for it := 0; it < iterations; it++ {
+		for t := range expected {
+			expected[t] = alpha
+		}
+		for _, w := range words {
+			var total float64
+			for t := range vector {
+				total += vector[t] * m.words.phi(w, t)
+			}
+			if total == 0 {
+				continue
+			}
+			for t := range vector {
+				expected[t] += vector[t] * m.words.phi(w, t) / total
+			}
+		}
+		next := normalized(expected)
+		var change float64
+		for t := range vector {
+			change += math.Abs(next[t] - vector[t])
+		}
+		copy(vector, next)
+		if change < 1e-9 {
+			break
+		}
+	}
+	return vector
+}
+
+func normalized(values []float64) []float64 {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	result := make([]float64, len(values))
+	for i, v := range values {
+		if sum > 0 {
+			result[i] = v / sum
+		}
+	}
+	return result
+}
+
+// ViewInfer places an unseen text in the model: it infers the text's topic
+// vector and finds its neighbors with the query options of
+// /view/{urn}/{count}/json except work. The text itself is not listed.
+func ViewInfer(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	m, release := modelFromRequest(w, r)
+	defer release()
+	if m == nil {
+		return
+	}
+	if m.words == nil || !m.words.hasWeights() {
+		http.Error(w, "this model has no topic-word weights (see topicWordSource)", http.StatusNotFound)
+		return
+	}
+	info, err := infoFromRequest(m, r)
+	if err == nil && info.Scope != "" {
+		err = fmt.Errorf("work does not apply to inferred texts")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var q inferQuery
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxInferQuery))
+	if err == nil {
+		err = json.Unmarshal(body, &q)
+	}
+	if err != nil {
+		http.Error(w, "reading query: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	vector, known, err := m.infer(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	text := q.Text
+	if q.Tokens != nil {
+		text = strings.Join(q.Tokens, " ")
+	}
+	info.ExcludeSelf = true
+	query := theta{Text: text, Vector: vector}
+	neighbors, distances := m.searchNear(query, nil, info)
+	result := inferResponse{
+		PassageJsonResponse: passageResponse(query, neighbors, distances, info),
+		Method:              strings.ToLower(q.Method),
+		Tokens:              len(q.tokens()),
+		Known:               known,
+		Theta:               vector,
+	}
+	if result.Method == "" {
+		result.Method = inferGibbs
+	}
+	resultJSON, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintln(w, string(resultJSON))
+}
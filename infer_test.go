@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// toyInferModel has two topics over three words: "sky" belongs to topic 0,
+// "sea" to topic 1 and "blue" to both.
+func toyInferModel(t *testing.T) *model {
+	dir, err := ioutil.TempDir("", "metallo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "weights.txt")
+	weights := "0\tsky\t9\n0\tblue\t1\n1\tsea\t9\n1\tblue\t1\n"
+	if err := ioutil.WriteFile(path, []byte(weights), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf := serverConfig{TopicWordSource: path, Local: true, InferAlpha: 0.01}
+	words, err := readTopicWords(conf, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &model{config: conf, words: words, store: newMemoryStore(nil, []string{"t0", "t1"})}
+}
+
+func TestReadTopicWeights(t *testing.T) {
+	m := toyInferModel(t)
+	if !m.words.hasWeights() {
+		t.Fatal("a weights file gave no weights")
+	}
+	if got := m.words.keys[0]; len(got) != 2 || got[0] != "sky" {
+		t.Errorf("top words of topic 0 = %v, want sky first", got)
+	}
+	w, ok := m.words.lookup("SKY")
+	if !ok || m.words.phi(w, 0) != 0.9 || m.words.phi(w, 1) != 0 {
+		t.Errorf("lookup(SKY) = %d, %v with phi %v, %v", w, ok, m.words.phi(w, 0), m.words.phi(w, 1))
+	}
+}
+
+func TestReadTopicKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metallo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys.txt")
+	if err := ioutil.WriteFile(path, []byte("0\t0.5\tsky blue\n1\t0.25\tsea blue\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tw, err := readTopicWords(serverConfig{TopicWordSource: path, Local: true}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tw.hasWeights() || tw.alphas[1] != 0.25 || tw.keys[1][0] != "sea" {
+		t.Errorf("keys file read as %+v", tw)
+	}
+}
+
+func TestFoldIn(t *testing.T) {
+	m := toyInferModel(t)
+	for _, method := range []string{inferGibbs, inferVariational} {
+		cases := []struct {
+			text   string
+			topic0 float64
+		}{
+			{"sky sky sky sky sky sky sky sky", 1},
+			{"sea sea sea sea sea sea sea sea", 0},
+			{"sky sky sky sky sea sea sea sea", 0.5},
+		}
+		for _, c := range cases {
+			vector, known, err := m.infer(inferQuery{Text: c.text, Method: method, Iterations: 200, Seed: 1})
+			if err != nil {
+				t.Fatalf("%s: %v", method, err)
+			}
+			if known != 8 {
+				t.Errorf("%s: %d known tokens, want 8", method, known)
+			}
+			if math.Abs(vector[0]+vector[1]-1) > 1e-9 {
+				t.Errorf("%s: %v does not sum to 1", method, vector)
+			}
+			if math.Abs(vector[0]-c.topic0) > 0.05 {
+				t.Errorf("%s %q: topic 0 at %.3f, want about %.1f", method, c.text, vector[0], c.topic0)
+			}
+		}
+	}
+	// The same seed gives the same sample.
+	a, _, _ := m.infer(inferQuery{Text: "sky blue sea blue", Seed: 7})
+	b, _, _ := m.infer(inferQuery{Text: "sky blue sea blue", Seed: 7})
+	if a[0] != b[0] {
+		t.Errorf("seed 7 gave %v and %v", a, b)
+	}
+	if _, _, err := m.infer(inferQuery{Text: "unknown words only"}); err == nil {
+		t.Error("inferred topics for a text without known words")
+	}
+	if _, _, err := m.infer(inferQuery{Text: "sky", Method: "magic"}); err == nil {
+		t.Error("accepted an unknown method")
+	}
+}
+
+// Posted tokens are taken as they are, even if they contain spaces.
+func TestInferTokens(t *testing.T) {
+	m := toyInferModel(t)
+	q := inferQuery{Tokens: []string{"blue sky", "sky"}, Text: "ignored when tokens are given"}
+	if got := len(q.tokens()); got != 2 {
+		t.Errorf("%d tokens, want 2", got)
+	}
+	if _, known, err := m.infer(q); err != nil || known != 1 {
+		t.Errorf("known = %d, err = %v; want 1 known token", known, err)
+	}
+}
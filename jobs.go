@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// jobStatus is what /jobs/{id} reports about a background job.
+type jobStatus struct {
+	ID       string      `json:"id"`
+	Kind     string      `json:"kind"`
+	Status   string      `json:"status"`
+	Done     int         `json:"done"`
+	Total    int         `json:"total"`
+	Started  time.Time   `json:"started"`
+	Finished *time.Time  `json:"finished,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Result   interface{} `json:"result,omitempty"`
+}
+
+// job is a computation too long for a single request, such as a summary
+// over the whole corpus. It runs in its own goroutine; clients poll it
+// until it is done and fetch the result before it expires.
+type job struct {
+	mu     sync.Mutex
+	status jobStatus
+	cancel context.CancelFunc
+}
+
+var jobs = struct {
+	sync.Mutex
+	byID map[string]*job
+	next int
+}{byID: map[string]*job{}}
+
+// Finished jobs, results included, are kept for jobTTL and at most
+// maxFinishedJobs of them; running jobs are always kept.
+const (
+	jobTTL          = time.Hour
+	maxFinishedJobs = 100
+)
+
+// pruneJobs forgets the finished jobs that are past jobTTL or beyond
+// maxFinishedJobs, oldest first. The caller holds the jobs lock.
+func pruneJobs(now time.Time) {
+	var finished []jobStatus
+	for id, j := range jobs.byID {
+		status := j.snapshot()
+		if status.Finished == nil {
+			continue
+		}
+		if now.Sub(*status.Finished) > jobTTL {
+			delete(jobs.byID, id)
+			continue
+		}
+		finished = append(finished, status)
+	}
+	if len(finished) <= maxFinishedJobs {
+		return
+	}
+	sort.Slice(finished, func(a, b int) bool { return finished[a].Finished.Before(*finished[b].Finished) })
+	for _, status := range finished[:len(finished)-maxFinishedJobs] {
+		delete(jobs.byID, status.ID)
+	}
+}
+
+// startJob runs fn in the background. fn reports progress through advance
+// and should stop early once ctx is cancelled, which happens on shutdown.
+func startJob(kind string, total int, fn func(ctx context.Context, j *job) (interface{}, error)) *job {
+	ctx, cancel := context.WithCancel(context.Background())
+	jobs.Lock()
+	pruneJobs(time.Now())
+	jobs.next++
+	j := &job{
+		status: jobStatus{ID: strconv.Itoa(jobs.next), Kind: kind, Status: "running", Total: total, Started: time.Now()},
+		cancel: cancel,
+	}
+	jobs.byID[j.status.ID] = j
+	jobs.Unlock()
+
+	go func() {
+		defer cancel()
+		result, err := fn(ctx, j)
+		finished := time.Now()
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		j.status.Finished = &finished
+		if err != nil {
+			j.status.Status = "failed"
+			j.status.Error = err.Error()
+			log.Printf("Job %s (%s) failed: %v", j.status.ID, kind, err)
+			return
+		}
+		j.status.Status = "done"
+		j.status.Result = result
+		log.Printf("Job %s (%s) done in %v.", j.status.ID, kind, finished.Sub(j.status.Started))
+	}()
+	return j
+}
+
+// advance records n more units of work as done.
+func (j *job) advance(n int) {
+	j.mu.Lock()
+	j.status.Done += n
+	j.mu.Unlock()
+}
+
+func (j *job) snapshot() jobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// parallelEach calls fn for every ID on all CPUs and advances j once per
+// ID. It stops handing out IDs once ctx is cancelled.
+func parallelEach(ctx context.Context, j *job, ids []string, fn func(id string)) error {
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range work {
+				fn(id)
+				j.advance(1)
+			}
+		}()
+	}
+	defer wg.Wait()
+	defer close(work)
+	for _, id := range ids {
+		select {
+		case work <- id:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// cancelJobs asks all running jobs to stop.
+func cancelJobs() {
+	jobs.Lock()
+	defer jobs.Unlock()
+	for _, j := range jobs.byID {
+		j.cancel()
+	}
+}
+
+// writeJobAccepted answers a request that started a job with 202 and
+// where to poll it.
+func writeJobAccepted(w http.ResponseWriter, j *job) {
+	status := j.snapshot()
+	resultJSON, _ := json.Marshal(status)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Location", "/jobs/"+status.ID)
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, string(resultJSON))
+}
+
+// ViewJob reports the progress, and in the end the result, of a job.
+func ViewJob(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	jobs.Lock()
+	pruneJobs(time.Now())
+	j, ok := jobs.byID[mux.Vars(r)["id"]]
+	jobs.Unlock()
+	if !ok {
+		http.Error(w, "no such job", http.StatusNotFound)
+		return
+	}
+	resultJSON, _ := json.Marshal(j.snapshot())
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintln(w, string(resultJSON))
+}
+
+// ListJobs reports all jobs without their results.
+func ListJobs(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	jobs.Lock()
+	pruneJobs(time.Now())
+	list := []jobStatus{}
+	for _, j := range jobs.byID {
+		status := j.snapshot()
+		status.Result = nil
+		list = append(list, status)
+	}
+	jobs.Unlock()
+	sort.Slice(list, func(a, b int) bool {
+		x, _ := strconv.Atoi(list[a].ID)
+		y, _ := strconv.Atoi(list[b].ID)
+		return x < y
+	})
+	resultJSON, _ := json.Marshal(list)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintln(w, string(resultJSON))
+}
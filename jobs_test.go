@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPruneJobs(t *testing.T) {
+	now := time.Now()
+	jobs.Lock()
+	defer jobs.Unlock()
+	saved := jobs.byID
+	defer func() { jobs.byID = saved }()
+
+	jobs.byID = map[string]*job{}
+	add := func(id string, finished *time.Time) {
+		jobs.byID[id] = &job{status: jobStatus{ID: id, Status: "done", Finished: finished}}
+	}
+	expired := now.Add(-jobTTL - time.Minute)
+	add("expired", &expired)
+	add("running", nil)
+	for i := 0; i < maxFinishedJobs+2; i++ {
+		finished := now.Add(-time.Duration(maxFinishedJobs+2-i) * time.Second)
+		add(strconv.Itoa(i), &finished)
+	}
+
+	pruneJobs(now)
+	if _, ok := jobs.byID["expired"]; ok {
+		t.Error("kept a job past its TTL")
+	}
+	if _, ok := jobs.byID["running"]; !ok {
+		t.Error("dropped a running job")
+	}
+	for _, id := range []string{"0", "1"} {
+		if _, ok := jobs.byID[id]; ok {
+			t.Errorf("kept job %s, one of the two oldest beyond the limit", id)
+		}
+	}
+	if len(jobs.byID) != maxFinishedJobs+1 {
+		t.Errorf("%d jobs left, want %d finished and 1 running", len(jobs.byID), maxFinishedJobs)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// topicLabel is what researchers have said about a topic: a readable
+// label to show instead of its column header, and a note.
+type topicLabel struct {
+	Label string `json:"label,omitempty"`
+	Note  string `json:"note,omitempty"`
+}
+
+// labelStore keeps the topic labels of a model in a JSON file (config:
+// labelPath) mapping topic numbers, from 1, to labels. The file lives
+// outside metallo.db, so labels survive rebuilding the database.
+type labelStore struct {
+	path   string
+	mu     sync.RWMutex
+	labels map[int]topicLabel
+}
+
+// Label stores are shared by path, so that a reload picks up the labels
+// set on the models it replaces.
+var (
+	labelStores   = map[string]*labelStore{}
+	labelStoresMu sync.Mutex
+)
+
+func openLabelStore(path string) (*labelStore, error) {
+	labelStoresMu.Lock()
+	defer labelStoresMu.Unlock()
+	if s, ok := labelStores[path]; ok {
+		return s, nil
+	}
+	s := &labelStore{path: path, labels: map[int]topicLabel{}}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var stored map[string]topicLabel
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return nil, fmt.Errorf("reading %s: %v", path, err)
+		}
+		for key, label := range stored {
+			topic, err := strconv.Atoi(key)
+			if err != nil {
+				return nil, fmt.Errorf("reading %s: %q is not a topic number", path, key)
+			}
+			s.labels[topic] = label
+		}
+	}
+	labelStores[path] = s
+	return s, nil
+}
+
+func (s *labelStore) get(topic int) topicLabel {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.labels[topic]
+}
+
+// set stores the label of a topic, or removes it if it is empty, and
+// writes the file. The file is replaced in one go, so a crash leaves the
+// old or the new labels but nothing in between.
+func (s *labelStore) set(topic int, label topicLabel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, had := s.labels[topic]
+	if label == (topicLabel{}) {
+		delete(s.labels, topic)
+	} else {
+		s.labels[topic] = label
+	}
+	stored := map[string]topicLabel{}
+	for t, l := range s.labels {
+		stored[strconv.Itoa(t)] = l
+	}
+	data, _ := json.MarshalIndent(stored, "", "  ")
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err == nil {
+		_, err = tmp.Write(data)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), s.path)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		if had {
+			s.labels[topic] = old
+		} else {
+			delete(s.labels, topic)
+		}
+		return fmt.Errorf("writing %s: %v", s.path, err)
+	}
+	return nil
+}
+
+// topicLabel is how topic k (from 0) is shown: its label if one is set,
+// else its column header.
+func (m *model) topicLabel(k int) string {
+	if label := m.labels.get(k + 1).Label; label != "" {
+		return label
+	}
+	return m.store.Topics()[k]
+}
+
+// topicLabels shows all topics as topicLabel does.
+func (m *model) topicLabels() []string {
+	labels := make([]string, len(m.store.Topics()))
+	for k := range labels {
+		labels[k] = m.topicLabel(k)
+	}
+	return labels
+}
+
+type labelEntry struct {
+	Topic  int    `json:"topic"` // numbered from 1
+	Header string `json:"header"`
+	topicLabel
+}
+
+func (m *model) labelEntry(k int) labelEntry {
+	return labelEntry{Topic: k + 1, Header: m.store.Topics()[k], topicLabel: m.labels.get(k + 1)}
+}
+
+// ListLabels exports the labels and notes of all topics.
+func ListLabels(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	m, release := modelFromRequest(w, r)
+	defer release()
+	if m == nil {
+		return
+	}
+	entries := make([]labelEntry, len(m.store.Topics()))
+	for k := range entries {
+		entries[k] = m.labelEntry(k)
+	}
+	resultJSON, _ := json.Marshal(entries)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintln(w, string(resultJSON))
+}
+
+// TopicLabel gets (GET), sets (PUT, with a JSON body of label and note) or
+// clears (DELETE) the label of a topic. Changing labels takes the admin
+// token, so it is refused while config.json sets none.
+func TopicLabel(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	m, release := modelFromRequest(w, r)
+	defer release()
+	if m == nil {
+		return
+	}
+	topic, err := topicFromRequest(m, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		if !adminAuthorized(w, r, "changing labels") {
+			return
+		}
+		var label topicLabel
+		if r.Method == http.MethodPut {
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<16))
+			if err == nil {
+				err = json.Unmarshal(body, &label)
+			}
+			if err != nil {
+				http.Error(w, "reading label: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if err := m.labels.set(topic+1, label); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	resultJSON, _ := json.Marshal(m.labelEntry(topic))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintln(w, string(resultJSON))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// duplicate records a passage that was not loaded because its ID was
+// already in the database.
+type duplicate struct {
+	ID   string
+	Line int
+}
+
+// bulkLoader collects passages and writes their vectors and texts in
+// batches, one transaction per batch.
+type bulkLoader struct {
+	store      *boltStore
+	size       int
+	width      int
+	pending    []theta
+	lines      []int
+	written    int
+	duplicates []duplicate
+}
+
+func newBulkLoader(s *boltStore, size, width int) *bulkLoader {
+	if size <= 0 {
+		size = 1000
+	}
+	return &bulkLoader{store: s, size: size, width: width}
+}
+
+// Add queues a passage read from the given source line and commits the
+// batch once it is full. It reports whether a commit happened.
+func (l *bulkLoader) Add(t theta, line int) (bool, error) {
+	l.pending = append(l.pending, t)
+	l.lines = append(l.lines, line)
+	if len(l.pending) < l.size {
+		return false, nil
+	}
+	return true, l.Flush()
+}
+
+// Flush commits whatever is queued.
+func (l *bulkLoader) Flush() error {
+	if len(l.pending) == 0 {
+		return nil
+	}
+	var written int
+	var duplicates []duplicate
+	err := l.store.Update(func(tx *bolt.Tx) error {
+		vectors := tx.Bucket(vectorsBucket)
+		texts := tx.Bucket(textsBucket)
+		if vectors == nil || texts == nil {
+			return fmt.Errorf("buckets %q and %q not found", vectorsBucket, textsBucket)
+		}
+		// Input usually arrives in ID order, so pack pages tightly.
+		vectors.FillPercent = 0.9
+		texts.FillPercent = 0.9
+		for i, t := range l.pending {
+			dbkey := []byte(t.ID)
+			if vectors.Get(dbkey) != nil {
+				duplicates = append(duplicates, duplicate{ID: t.ID, Line: l.lines[i]})
+				continue
+			}
+			if err := vectors.Put(dbkey, encodeVector(t.Vector, l.width)); err != nil {
+				return err
+			}
+			if err := texts.Put(dbkey, []byte(t.Text)); err != nil {
+				return err
+			}
+			if len(t.Meta) > 0 {
+				if err := putMeta(tx, dbkey, t.Meta); err != nil {
+					return err
+				}
+			}
+			written++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	l.written += written
+	l.duplicates = append(l.duplicates, duplicates...)
+	l.pending = l.pending[:0]
+	l.lines = l.lines[:0]
+	return nil
+}
+
+// progress prints a single updating status line with throughput and, when
+// the input size is known, an estimate of the time left.
+type progress struct {
+	start time.Time
+	total int64
+}
+
+func newProgress(total int64) *progress {
+	return &progress{start: time.Now(), total: total}
+}
+
+func (p *progress) report(w io.Writer, records int, offset int64) {
+	elapsed := time.Since(p.start)
+	rate := float64(records) / elapsed.Seconds()
+	status := fmt.Sprintf("\rWrote %d records to the database (%.0f records/s", records, rate)
+	if p.total > 0 && offset > 0 {
+		done := float64(offset) / float64(p.total)
+		eta := time.Duration(float64(elapsed) * (1 - done) / done)
+		status += fmt.Sprintf(", %.1f%%, ETA %v", done*100, eta.Round(time.Second))
+	}
+	fmt.Fprint(w, status+").   ")
+}
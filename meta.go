@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// metaJoin adds passage metadata from a sidecar file.
+type metaJoin struct {
+	thetaReader
+	meta map[string]map[string]string
+}
+
+func (j *metaJoin) Next() (theta, error) {
+	t, err := j.thetaReader.Next()
+	if err == nil {
+		if meta, ok := j.meta[t.ID]; ok {
+			if t.Meta == nil {
+				t.Meta = map[string]string{}
+			}
+			for key, value := range meta {
+				t.Meta[key] = value
+			}
+		}
+	}
+	return t, err
+}
+
+// readMeta reads passage metadata keyed by ID. JSON files hold either an
+// object mapping IDs to objects of fields or an array of objects with an
+// "id" field. Anything else is read as CSV (tab-separated for .tsv and
+// .txt) with a header; the ID is in the "id" column, or else the first.
+func readMeta(file string, local bool) (map[string]map[string]string, error) {
+	source, _, err := openResource(file, local)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+	if strings.ToLower(filepath.Ext(file)) == ".json" {
+		data, err := ioutil.ReadAll(source)
+		if err != nil {
+			return nil, err
+		}
+		meta, err := parseJSONMeta(data)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", file, err)
+		}
+		return meta, nil
+	}
+
+	buffered := bufio.NewReader(source)
+	skipBOM(buffered)
+	reader := csv.NewReader(buffered)
+	reader.LazyQuotes = true
+	reader.FieldsPerRecord = -1
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".tsv", ".txt":
+		reader.Comma = '\t'
+	}
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", file, err)
+	}
+	idColumn := 0
+	for j, name := range header {
+		if strings.EqualFold(name, "id") {
+			idColumn = j
+		}
+	}
+	meta := map[string]map[string]string{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", file, err)
+		}
+		if idColumn >= len(record) {
+			continue
+		}
+		fields := map[string]string{}
+		for j, value := range record {
+			if j != idColumn && j < len(header) && value != "" {
+				fields[header[j]] = value
+			}
+		}
+		meta[record[idColumn]] = fields
+	}
+	return meta, nil
+}
+
+func parseJSONMeta(data []byte) (map[string]map[string]string, error) {
+	meta := map[string]map[string]string{}
+	var byID map[string]map[string]interface{}
+	if err := json.Unmarshal(data, &byID); err == nil {
+		for id, fields := range byID {
+			meta[id] = metaStrings(fields)
+		}
+		return meta, nil
+	}
+	var list []map[string]interface{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("expected an object keyed by ID or an array of objects")
+	}
+	for i, fields := range list {
+		id, ok := fields["id"].(string)
+		if !ok {
+			return nil, fmt.Errorf("entry %d has no string id", i)
+		}
+		delete(fields, "id")
+		meta[id] = metaStrings(fields)
+	}
+	return meta, nil
+}
+
+// metaStrings flattens JSON values to the strings metadata is kept as.
+func metaStrings(fields map[string]interface{}) map[string]string {
+	result := make(map[string]string, len(fields))
+	for key, value := range fields {
+		switch v := value.(type) {
+		case nil:
+		case string:
+			result[key] = v
+		case float64:
+			result[key] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			encoded, _ := json.Marshal(v)
+			result[key] = string(encoded)
+		}
+	}
+	return result
+}
+
+// metaFilter is one ?filter= condition, such as author:Dharmakirti or
+// century<8.
+type metaFilter struct {
+	key, op, value string
+}
+
+// Filter operators; ":" tests equality.
+var filterOps = []string{"<=", ">=", "!=", "<", ">", ":"}
+
+func parseFilter(s string) (metaFilter, error) {
+	for i := range s {
+		for _, op := range filterOps {
+			if strings.HasPrefix(s[i:], op) {
+				f := metaFilter{key: strings.TrimSpace(s[:i]), op: op, value: strings.TrimSpace(s[i+len(op):])}
+				if f.key == "" {
+					return f, fmt.Errorf("filter %q names no field", s)
+				}
+				return f, nil
+			}
+		}
+	}
+	return metaFilter{}, fmt.Errorf("filter %q has no operator (use one of : != < <= > >=)", s)
+}
+
+// matches compares a metadata value with the filter, numerically if both
+// are numbers and else as case-insensitive text. A passage without the
+// field only passes != filters.
+func (f metaFilter) matches(meta map[string]string) bool {
+	value, ok := meta[f.key]
+	if !ok {
+		return f.op == "!="
+	}
+	var c int
+	x, errX := strconv.ParseFloat(value, 64)
+	y, errY := strconv.ParseFloat(f.value, 64)
+	if errX == nil && errY == nil {
+		switch {
+		case x < y:
+			c = -1
+		case x > y:
+			c = 1
+		}
+	} else {
+		c = strings.Compare(strings.ToLower(value), strings.ToLower(f.value))
+	}
+	switch f.op {
+	case ":":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+// metaFilters turns ?filter= values into a test on passage IDs, or nil if
+// there are none. Equality filters on the same field are alternatives
+// (author:A&filter=author:B); everything else must hold together.
+func (m *model) metaFilters(values []string) (func(id string) bool, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	var all []metaFilter
+	anyOf := map[string][]metaFilter{}
+	for _, v := range values {
+		f, err := parseFilter(v)
+		if err != nil {
+			return nil, err
+		}
+		if f.op == ":" {
+			anyOf[f.key] = append(anyOf[f.key], f)
+		} else {
+			all = append(all, f)
+		}
+	}
+	return func(id string) bool {
+		meta := m.meta[id]
+		for _, f := range all {
+			if !f.matches(meta) {
+				return false
+			}
+		}
+		for _, alternatives := range anyOf {
+			ok := false
+			for _, f := range alternatives {
+				if f.matches(meta) {
+					ok = true
+					break
+				}
+			}
+			if !ok {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	cases := map[string]metaFilter{
+		"author:Dharmakirti": {"author", ":", "Dharmakirti"},
+		"century<=8":         {"century", "<=", "8"},
+		"century >= 6":       {"century", ">=", "6"},
+		"school!=Nyaya":      {"school", "!=", "Nyaya"},
+		"century<8":          {"century", "<", "8"},
+		"title:a:b":          {"title", ":", "a:b"},
+	}
+	for s, want := range cases {
+		got, err := parseFilter(s)
+		if err != nil || got != want {
+			t.Errorf("parseFilter(%q) = %+v, %v; want %+v", s, got, err, want)
+		}
+	}
+	for _, bad := range []string{"author", ":value", ""} {
+		if _, err := parseFilter(bad); err == nil {
+			t.Errorf("parseFilter(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestMetaFilterMatches(t *testing.T) {
+	meta := map[string]string{"author": "Dharmakirti", "century": "7"}
+	cases := []struct {
+		filter string
+		want   bool
+	}{
+		{"author:dharmakirti", true}, // case-insensitive
+		{"author:Dignaga", false},
+		{"author!=Dignaga", true},
+		{"century<10", true}, // numeric, though "10" < "7" as text
+		{"century>=7", true},
+		{"century>7", false},
+		{"century<=6.5", false},
+		{"school:Nyaya", false}, // missing fields only pass !=
+		{"school!=Nyaya", true},
+	}
+	for _, c := range cases {
+		f, err := parseFilter(c.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.matches(meta); got != c.want {
+			t.Errorf("%s matches %v = %v, want %v", c.filter, meta, got, c.want)
+		}
+	}
+}
+
+func TestMetaFilters(t *testing.T) {
+	m := &model{meta: map[string]map[string]string{
+		"a": {"author": "Dharmakirti", "century": "7"},
+		"b": {"author": "Dignaga", "century": "6"},
+		"c": {"author": "Vasubandhu", "century": "5"},
+		"d": {"author": "Dharmakirti", "century": "8"},
+	}}
+	keep, err := m.metaFilters([]string{"author:Dharmakirti", "author:Dignaga", "century<8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept []string
+	for _, id := range []string{"a", "b", "c", "d"} {
+		if keep(id) {
+			kept = append(kept, id)
+		}
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(kept, want) {
+		t.Errorf("kept %v, want %v", kept, want)
+	}
+	if keep, err := m.metaFilters(nil); keep != nil || err != nil {
+		t.Error("no filters should give no test")
+	}
+	if _, err := m.metaFilters([]string{"author"}); err == nil {
+		t.Error("accepted a filter without an operator")
+	}
+}
@@ -1,12 +1,11 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"encoding/csv"
 	"encoding/gob"
 	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
 	"html/template"
@@ -16,14 +15,16 @@ import (
 	"math"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
-	"github.com/boltdb/bolt"
 	"github.com/gorilla/mux"
 )
 
@@ -31,6 +32,7 @@ type theta struct {
 	ID     string
 	Text   string
 	Vector []float64
+	Meta   map[string]string
 }
 
 type ptopic struct {
@@ -46,48 +48,51 @@ type Divergence struct {
 }
 
 type serverConfig struct {
+	Name         string  `json:"name"`
 	Host         string  `json:"host"`
 	Port         string  `json:"port"`
 	Source       string  `json:"csv_source"`
+	Format       string  `json:"format"`
+	TextSource   string  `json:"text_source"`
+	MetaSource   string  `json:"metaSource"`
+	MetaColumns  []string `json:"metaColumns"`
+	TopicWordSource string `json:"topicWordSource"`
+	InferAlpha   float64 `json:"inferAlpha"`
+	IDSource     string  `json:"id_source"`
+	Validation   string  `json:"validation"`
+	NormTolerance float64 `json:"normTolerance"`
 	Local        bool    `json:"local"`
 	DB           bool    `json:"db"`
+	DBPath       string  `json:"dbPath"`
+	LabelPath    string  `json:"labelPath"`
+	DBTimeout    float64 `json:"dbTimeout"`
+	BatchSize    int     `json:"batchSize"`
+	Float32Vectors bool  `json:"float32Vectors"`
 	Significance float64 `json:"significance"`
 	DimWeight	float64 `json:"dimWeight"`
 	VizWeight	float64 `json:"vizWeight"`
 	Distance     string  `json:"distance"`
+	Weights      []float64 `json:"weights"`
+	MaskTopics   []int   `json:"maskTopics"`
+	MergeTopics  [][]int `json:"mergeTopics"`
+	Index        bool    `json:"index"`
+	IndexSlack   float64 `json:"indexSlack"`
+	WorkRule     string  `json:"workRule"`
+	WorkPattern  string  `json:"workPattern"`
 	DivMax       float64 `json:"divMax"`
+	AdminToken   string  `json:"adminToken"`
+	Models       []json.RawMessage `json:"models"`
 	FileLimit	int `json:"fileLimit"`
 }
 
-var templates = template.Must(template.ParseFiles(filepath.Join("tmpl", "view.html"), filepath.Join("tmpl", "index.html")))
+var templates = template.Must(template.ParseFiles(filepath.Join("tmpl", "view.html"), filepath.Join("tmpl", "index.html"), filepath.Join("tmpl", "topic.html"), filepath.Join("tmpl", "trajectory.html")))
 
 var confvar = loadConfiguration("config.json")
-var topics = []string{}
-var backend = []theta{}
-var significant = confvar.Significance
 var port = confvar.Port
-var address = confvar.Host
-var distance = confvar.Distance
 var pwd, _ = os.Getwd()
 var dbname = filepath.Join(pwd, "metallo.db")
 var distnorm float64
 
-func retrieveTopics() (topics []string) {
-	db, err := bolt.Open(dbname, 0644, nil)
-	check(err)
-	err = db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte("topics"))
-		if bucket == nil {
-			return fmt.Errorf("bucket not found")
-		}
-		val := bucket.Get([]byte("topics"))
-		topics, _ = gobDecodeTopics(val)
-		return nil
-	})
-	db.Close()
-	return topics
-}
-
 func gobEncode(p interface{}) ([]byte, error) {
 	buf := new(bytes.Buffer)
 	enc := gob.NewEncoder(buf)
@@ -120,234 +125,113 @@ func gobDecodeTopics(data []byte) ([]string, error) {
 	return *p, nil
 }
 
-func thetaToDB(thetafile theta) error {
-	dbkey := []byte(thetafile.ID)
-	dbvalue, err := gobEncode(&thetafile)
-
-	db, err := bolt.Open(dbname, 0644, nil)
+func readThetaNoDB(conf serverConfig) (result []theta, topics []string, err error) {
+	log.Println("Reading file.")
+	reader, _, err := openThetaReader(conf)
 	if err != nil {
-		return err
+		return nil, nil, fmt.Errorf("could not open %s: %v", conf.Source, err)
 	}
-	defer db.Close()
-	err = db.Update(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists([]byte("theta"))
-		if err != nil {
-			return err
-		}
-		val := bucket.Get(dbkey)
-		if val != nil {
-			return errors.New("work exists already")
-		}
-		err = bucket.Put(dbkey, dbvalue)
-		if err != nil {
-			return err
-		}
-		return nil
-	})
+	defer reader.Close()
+	validation, err := newValidator(conf, len(reader.Topics()))
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	return nil
-}
 
-func readThetaNoDB() (result []theta, topics []string) {
-	file := confvar.Source
-	log.Println("Reading file.")
-	switch confvar.Local {
-	case false:
-		log.Println("Fetching external resource.")
-		data, err := getContent(file)
-		check(err)
-		str := string(data)
-		reader := csv.NewReader(strings.NewReader(str))
-		reader.LazyQuotes = true
-		lines, err := reader.ReadAll()
-		if err != nil {
-			log.Fatalf("error reading all lines: %v", err)
+	recordcount := 0
+	for {
+		t, err := reader.Next()
+		if err == io.EOF {
+			break
 		}
-
-		for i, line := range lines {
-			if i == 0 {
-				for i := range line {
-					if i < 3 {
-						continue
-					}
-					topics = append(topics, line[i])
-				}
-				continue
-			}
-			identifier := line[1]
-			text := line[2]
-			vector := []float64{}
-			for i := range line[3:len(line)] {
-				index := i + 3
-				floatvalue, _ := strconv.ParseFloat(line[index], 64)
-				vector = append(vector, floatvalue)
-			}
-			result = append(result, theta{ID: identifier, Text: text, Vector: vector})
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading %s: %v", conf.Source, err)
 		}
-		log.Println("All is read.")
-	case true:
-		log.Println("Fetching internal resource.")
-		f, err := os.Open(file)
+		t, keep, err := validation.check(t, reader.Line())
 		if err != nil {
-			log.Println("could not open file")
+			validation.report.write()
+			return nil, nil, fmt.Errorf("aborting: %v", err)
 		}
-		defer f.Close()
-		reader := csv.NewReader(bufio.NewReader(f))
-		reader.LazyQuotes = true
-
-		linecount := 0
-		recordcount := 0
-		for {
-			record, err := reader.Read()
-			if err == io.EOF {
-				break
-			}
-			if linecount == 0 {
-				for j := range record {
-					if j < 3 {
-						continue
-					}
-					topics = append(topics, record[j])
-				}
-				linecount++
-				continue
-			}
-			identifier := record[1]
-			text := record[2]
-			vector := []float64{}
-			for j := range record[3:len(record)] {
-				index := j + 3
-				floatvalue, _ := strconv.ParseFloat(record[index], 64)
-				vector = append(vector, floatvalue)
-			}
-			result = append(result, theta{ID: identifier, Text: text, Vector: vector})
-			recordcount++
+		if !keep {
+			continue
+		}
+		result = append(result, t)
+		recordcount++
+		if recordcount%1000 == 0 {
 			fmt.Printf("\rWrote %d records to memory.", recordcount)
 		}
-		fmt.Println()
-		log.Println("All is read and written.")
 	}
-	return result, topics
+	fmt.Printf("\rWrote %d records to memory.", recordcount)
+	fmt.Println()
+	log.Println("All is read and written.")
+	validation.report.write()
+	return result, reader.Topics(), nil
 }
 
-func readTheta() []string {
-	os.Remove(dbname)
-	file := confvar.Source
+func readTheta(conf serverConfig, db *boltStore) error {
 	log.Println("Reading file.")
-	var topics []string
-	switch confvar.Local {
-	case false:
-		log.Println("Fetching external resource.")
-		data, _ := getContent(file)
-		str := string(data)
-		reader := csv.NewReader(strings.NewReader(str))
-		reader.LazyQuotes = true
-		lines, err := reader.ReadAll()
-		if err != nil {
-			log.Fatalf("error reading all lines: %v", err)
-		}
+	reader, size, err := openThetaReader(conf)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %v", conf.Source, err)
+	}
+	defer reader.Close()
+	validation, err := newValidator(conf, len(reader.Topics()))
+	if err != nil {
+		return err
+	}
 
-		for i, line := range lines {
-			if i == 0 {
-				for i := range line {
-					if i < 3 {
-						continue
-					}
-					topics = append(topics, line[i])
-				}
-				continue
-			}
-			identifier := line[1]
-			text := line[2]
-			vector := []float64{}
-			for i := range line[3:len(line)] {
-				index := i + 3
-				floatvalue, _ := strconv.ParseFloat(line[index], 64)
-				vector = append(vector, floatvalue)
-			}
-			thetaToDB(theta{ID: identifier, Text: text, Vector: vector})
+	loader := newBulkLoader(db, conf.BatchSize, vectorWidth(conf))
+	status := newProgress(size)
+	recordcount := 0
+	for {
+		t, err := reader.Next()
+		if err == io.EOF {
+			break
 		}
-		log.Println("All is read.")
-	case true:
-		log.Println("Fetching internal resource.")
-		f, err := os.Open(file)
 		if err != nil {
-			log.Println("could not open file")
-		}
-		defer f.Close()
-		reader := csv.NewReader(bufio.NewReader(f))
-		reader.LazyQuotes = true
-
-		linecount := 0
-		recordcount := 0
-		for {
-			record, err := reader.Read()
-			if err == io.EOF {
-				break
-			}
-			if linecount == 0 {
-				for j := range record {
-					if j < 3 {
-						continue
-					}
-					topics = append(topics, record[j])
-				}
-				linecount++
-				continue
-			}
-			identifier := record[1]
-			text := record[2]
-			vector := []float64{}
-			for j := range record[3:len(record)] {
-				index := j + 3
-				floatvalue, _ := strconv.ParseFloat(record[index], 64)
-				vector = append(vector, floatvalue)
-			}
-			thetaToDB(theta{ID: identifier, Text: text, Vector: vector})
-			recordcount++
-			fmt.Printf("\rWrote %d records to the database.", recordcount)
+			return fmt.Errorf("error reading %s: %v", conf.Source, err)
 		}
-		fmt.Println()
-		log.Println("All is read and written.")
-	}
-
-	dbkey := []byte("topics")
-	dbvalue, err := gobEncode(&topics)
-	db, err := bolt.Open(dbname, 0644, nil)
-	check(err)
-	defer db.Close()
-	err = db.Update(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists([]byte("topics"))
+		t, keep, err := validation.check(t, reader.Line())
 		if err != nil {
-			return err
+			validation.report.write()
+			return fmt.Errorf("aborting: %v", err)
+		}
+		if !keep {
+			continue
 		}
-		err = bucket.Put(dbkey, dbvalue)
+		committed, err := loader.Add(t, reader.Line())
 		if err != nil {
 			return err
 		}
-		return nil
-	})
-	check(err)
-	return topics
+		recordcount++
+		if committed {
+			status.report(os.Stdout, recordcount, reader.Offset())
+		}
+	}
+	if err := loader.Flush(); err != nil {
+		return err
+	}
+	status.report(os.Stdout, recordcount, size)
+	fmt.Println()
+	log.Printf("All is read and written: %d passages stored.", loader.written)
+	validation.addDuplicates(loader.duplicates)
+	validation.report.write()
+
+	return db.PutTopics(reader.Topics())
 }
 
 func main() {
 	loadDB := flag.Bool("loadDB", false, "load DB from CSV")
+	migrate := flag.Bool("migrateDB", false, "convert a DB written by an older version to the current format")
+	verify := flag.Int("verifyIndex", 0, "check index recall against exact scans for this many sample queries")
 	flag.Parse()
-	if confvar.DB {
-		if *loadDB {
-			log.Println("(Re-)building the db...")
-			topics = readTheta()
-		} else {
-			log.Println("Starting without re-building the db...")
-			topics = retrieveTopics()
-		}
-	} else {
-		log.Println("Starting without a database. Keeping it all in memory...")
-		backend, topics = readThetaNoDB()
+	loaded, names, err := loadModels(confvar, loadOptions{rebuild: *loadDB, migrate: *migrate})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, name := range names {
+		loaded[name].verifyIndex(*verify, 10)
 	}
+	models, modelNames = loaded, names
 	router := mux.NewRouter().StrictSlash(true)
 	s := http.StripPrefix("/static/", http.FileServer(http.Dir("static")))
 	js := http.StripPrefix("/js/", http.FileServer(http.Dir("js")))
@@ -359,28 +243,102 @@ func main() {
 	router.PathPrefix("/processed/").Handler(processed)
 	router.PathPrefix("/theta/").Handler(theta)
 	router.PathPrefix("/ldavis/").Handler(ldavis)
-	router.HandleFunc("/view/{urn}/{count}", ViewPage)
-	router.HandleFunc("/view/{urn}/{count}/json", ViewPageJs)
-	router.HandleFunc("/topic/{topic}/{count}", ViewTopic)
-	router.HandleFunc("/divergenceJS", DivergenceJS)
-	router.HandleFunc("/divergenceCSV", DivergenceCSV)
+	// Model routes answer for the default model at the top level and for
+	// any model under /models/{model}.
+	for _, r := range []*mux.Router{router, router.PathPrefix("/models/{model}").Subrouter()} {
+		r.HandleFunc("/view/{urn}/{count}", ViewPage)
+		r.HandleFunc("/view/{urn}/{count}/json", ViewPageJs)
+		r.HandleFunc("/topic/{topic}", ViewTopicPage)
+		r.HandleFunc("/topic/{topic}/json", ViewTopicJSON)
+		r.HandleFunc("/topic/{topic}/label", TopicLabel).Methods("GET", "PUT", "DELETE")
+		r.HandleFunc("/labels", ListLabels)
+		r.HandleFunc("/topic/{topic}/{count}", ViewTopic)
+		r.HandleFunc("/topic/{topic}/{count}/json", ViewTopicRankingJSON)
+		r.HandleFunc("/topic/{topic}/{count}/csv", ViewTopicRankingCSV)
+		r.HandleFunc("/vector/{count}/json", ViewVector).Methods("POST")
+		r.HandleFunc("/centroid/{count}/json", ViewCentroid).Methods("POST")
+		r.HandleFunc("/infer/{count}/json", ViewInfer).Methods("POST")
+		r.HandleFunc("/divergenceJS", DivergenceJS)
+		r.HandleFunc("/divergenceCSV", DivergenceCSV)
+		r.HandleFunc("/view/{urn}/{count}/works", ViewWorks)
+		r.HandleFunc("/works", ListWorks)
+		r.HandleFunc("/trajectory/{urn}", ViewTrajectoryPage)
+		r.HandleFunc("/trajectory/{urn}/json", ViewTrajectoryJSON)
+		r.HandleFunc("/trajectory/{urn}/csv", ViewTrajectoryCSV)
+		r.HandleFunc("/stats", ViewStats)
+		r.HandleFunc("/stats/{work}", ViewStats)
+		r.HandleFunc("/passages/{urn}", ViewPassages)
+		r.HandleFunc("/works/matrix", WorkMatrix)
+		r.HandleFunc("/works/matrix/links/{count}", WorkLinkMatrix).Methods("POST")
+	}
+	router.HandleFunc("/models", ListModels)
+	router.HandleFunc("/compare/{a}/{b}/{urn}/{count}/json", CompareModels)
+	router.HandleFunc("/compare/{a}/{b}/summary/{count}", CompareSummary).Methods("POST")
+	router.HandleFunc("/jobs", ListJobs)
+	router.HandleFunc("/jobs/{id}", ViewJob)
+	router.HandleFunc("/admin/reload", AdminReload).Methods("POST")
 	router.HandleFunc("/", Index)
+	server := &http.Server{Addr: port, Handler: router}
+	done := make(chan struct{})
+	go shutdownOnSignal(server, done)
+	go reloadOnHangup()
 	log.Println("Listening at" + port + "...")
-	log.Fatal(http.ListenAndServe(port, router))
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
+}
+
+// shutdownOnSignal stops accepting requests on SIGINT or SIGTERM, lets the
+// running ones finish, cancels background jobs and then closes the databases
+// cleanly.
+func shutdownOnSignal(server *http.Server, done chan<- struct{}) {
+	defer close(done)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigs
+	log.Println("Received", sig, "- shutting down...")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("shutdown:", err)
+	}
+	cancelJobs()
+	closeModels()
+}
+
+// dbTimeout is how long to wait for the lock on metallo.db, e.g. while
+// another Metallo process still holds it.
+func dbTimeout(conf serverConfig) time.Duration {
+	if conf.DBTimeout <= 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(conf.DBTimeout * float64(time.Second))
 }
 
 func loadConfiguration(file string) serverConfig {
-	var config serverConfig
-	configFile, err := os.Open(file)
-	defer configFile.Close()
+	config, err := readConfiguration(file)
 	if err != nil {
 		log.Println(err.Error())
 	}
-	jsonParser := json.NewDecoder(configFile)
-	jsonParser.Decode(&config)
 	return config
 }
 
+// readConfiguration is loadConfiguration for reloads, where a broken
+// config.json must not replace a working one.
+func readConfiguration(file string) (serverConfig, error) {
+	var config serverConfig
+	configFile, err := os.Open(file)
+	if err != nil {
+		return config, err
+	}
+	defer configFile.Close()
+	if err := json.NewDecoder(configFile).Decode(&config); err != nil {
+		return config, fmt.Errorf("%s: %v", file, err)
+	}
+	return config, nil
+}
+
 // a function to enable CORS on a particular requestion
 func enableCors(w *http.ResponseWriter) {
 	(*w).Header().Set("Access-Control-Allow-Origin", "*")
@@ -394,18 +352,44 @@ func Index(w http.ResponseWriter, r *http.Request) {
 }
 
 func ViewPage(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	urn := vars["urn"]
-	count, _ := strconv.Atoi(vars["count"])
-	info := Info{
-		URN:   urn,
-		Count: count}
-
-	p, _ := loadPage(info, address)
+	m, release := modelFromRequest(w, r)
+	defer release()
+	if m == nil {
+		return
+	}
+	info, err := infoFromRequest(m, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p, err := loadPage(m, info, m.config.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 	renderTemplate(w, "view", p)
 }
 
 func DivergenceJS(w http.ResponseWriter, r *http.Request) {
+	m, release := modelFromRequest(w, r)
+	defer release()
+	if m == nil {
+		return
+	}
+	projection, err := m.projectionFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	backend, err := allThetas(m.store)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if projection != nil {
+		backend = projection.projectAll(backend)
+	}
 	var resultJS []Divergence
 	for i, v := range backend {
 		// resultJS = append(resultJS, Divergence{SourceID: v.ID, TargetID: v.ID, JSDivergence: float64(0)})
@@ -415,7 +399,7 @@ func DivergenceJS(w http.ResponseWriter, r *http.Request) {
 		}
 		for j := startIter; j < len(backend); j++ {
 			newfloat := jensenShannon(v.Vector, backend[j].Vector)
-			if newfloat < confvar.DivMax {
+			if newfloat < m.config.DivMax {
 				resultJS = append(resultJS, Divergence{SourceID: v.ID, TargetID: backend[j].ID, JSDivergence: newfloat})
 			}
 		}
@@ -431,22 +415,40 @@ func DivergenceCSV(w http.ResponseWriter, r *http.Request) {
 		numCPU = 1
 	}
 	log.Println("metallo is using", numCPU, "cores")
+	m, release := modelFromRequest(w, r)
+	defer release()
+	if m == nil {
+		return
+	}
+	projection, err := m.projectionFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	backend, err := allThetas(m.store)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if projection != nil {
+		backend = projection.projectAll(backend)
+	}
 	var divided []func()
 	chunkSize := (len(backend) + numCPU - 1) / numCPU
 	for i := 0; i < numCPU; i++ {
 		idx := i * chunkSize
 		if i >= numCPU-1 {
 			divided = append(divided, func() {
-				prepareCSVs(backend[idx:], idx)
+				prepareCSVs(m.config, backend, backend[idx:], idx)
 			})
 		} else {
 			end := i*chunkSize + chunkSize + 1
 			divided = append(divided, func() {
-				prepareCSVs(backend[idx:end], idx)
+				prepareCSVs(m.config, backend, backend[idx:end], idx)
 			})
 		}
 	}
-	err := writeIDMap("mapID.csv")
+	err = writeIDMap(backend, "mapID.csv")
 	check(err)
 	Parallelize(divided...)
 	fmt.Fprintln(w, "all results produced.")
@@ -456,9 +458,9 @@ func testPar(temptheta []theta) {
 	log.Println(temptheta[0].ID, temptheta[len(temptheta)-1].ID)
 }
 
-func prepareCSVs(temptheta []theta, startInd int) {
+func prepareCSVs(conf serverConfig, backend, temptheta []theta, startInd int) {
 	resultCSV := []Divergence{}
-	csvlength := len(backend) * confvar.FileLimit
+	csvlength := len(backend) * conf.FileLimit
 	mcount := 0
 	count := 0
 	index := startInd
@@ -478,7 +480,7 @@ func prepareCSVs(temptheta []theta, startInd int) {
 				continue
 			}
 			newfloat := jensenShannon(v.Vector, backend[j].Vector)
-			if newfloat < confvar.DivMax {
+			if newfloat < conf.DivMax {
 				resultCSV = append(resultCSV, Divergence{SourceID: strconv.Itoa(startInd + startIter),
 					TargetID: strconv.Itoa(j + 1),
 					JSDivergence: newfloat})
@@ -515,7 +517,7 @@ func Parallelize(functions ...func()) {
 	}
 }
 
-func writeIDMap(filename string) error {
+func writeIDMap(backend []theta, filename string) error {
 	fp := filepath.Join("processed", filename)
 	csvFile, err := os.Create(fp)
 	if err != nil {
@@ -564,17 +566,21 @@ func writeCSV(data []Divergence, filename string) error {
 func ViewPageJs(w http.ResponseWriter, r *http.Request) {
 	enableCors(&w)
 
-	vars := mux.Vars(r)
-	urn := vars["urn"]
-	count, _ := strconv.Atoi(vars["count"])
-
-	info := Info{
-		URN:   urn,
-		Count: count}
+	m, release := modelFromRequest(w, r)
+	defer release()
+	if m == nil {
+		return
+	}
+	info, err := infoFromRequest(m, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	p, errorResponse := JsonResponse(info)
+	p, errorResponse := JsonResponse(m, info)
 	if errorResponse != nil {
-		fmt.Fprintln(w, string("error"))
+		http.Error(w, errorResponse.Error(), http.StatusNotFound)
+		return
 	}
 
 	resultJSON, _ := json.Marshal(p)
@@ -582,83 +588,41 @@ func ViewPageJs(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, string(resultJSON))
 }
 
+// ViewTopic lists the passages strongest in a topic as plain text. It
+// takes the options of the JSON and CSV variants.
 func ViewTopic(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	topic, _ := strconv.Atoi(vars["topic"])
-	count, _ := strconv.Atoi(vars["count"])
-	thetas := make([]theta, count)
-	resultsorted := make([]ptopic, count)
-	topic = topic - 1
-	if confvar.DB {
-		db, err := bolt.Open(dbname, 0644, nil)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer db.Close()
-		db.View(func(tx *bolt.Tx) error {
-			// Assume bucket exists and has keys
-			b := tx.Bucket([]byte("theta"))
-
-			c := b.Cursor()
-			indexcount := 0
-
-			for k, v := c.First(); k != nil; k, v = c.Next() {
-				newtheta, _ := gobDecode(v)
-				if indexcount < count {
-					thetas[indexcount] = newtheta
-					indexcount++
-					continue
-				}
-				minindex, minfloat := minIndexTheta(thetas, topic)
-				if newtheta.Vector[topic] > minfloat {
-					thetas[minindex] = newtheta
-				}
-			}
-			return nil
-		})
-	} else {
-		indexcount := 0
-		for _, v := range backend {
-			newtheta := v
-			if indexcount < count {
-				thetas[indexcount] = newtheta
-				indexcount++
-				continue
-			}
-			minindex, minfloat := minIndexTheta(thetas, topic)
-			if newtheta.Vector[topic] > minfloat {
-				thetas[minindex] = newtheta
-			}
-		}
+	m, release := modelFromRequest(w, r)
+	defer release()
+	if m == nil {
+		return
 	}
-	for _, v := range thetas {
-		resultsorted = append(resultsorted, ptopic{ID: v.ID, Text: v.Text, Value: v.Vector[topic]})
+	ranking, ok := topicRankingFromRequest(w, r, m)
+	if !ok {
+		return
 	}
 
 	var results []string
 
-	for i := range resultsorted {
+	for i, item := range ranking.Items {
 		resultstring1 := ""
 		switch i {
 		case 0:
-			resultstring1 = "Rank " + strconv.Itoa(i+1) + ":"
+			resultstring1 = "Rank " + strconv.Itoa(item.Rank) + ":"
 		default:
-			resultstring1 = "\n" + "Rank " + strconv.Itoa(i+1) + ":"
+			resultstring1 = "\n" + "Rank " + strconv.Itoa(item.Rank) + ":"
 		}
-		maxindex, maxfloat := maxIndexTheta(resultsorted)
-		percentage := "Topic" + vars["topic"] + ": "
-		percfloat := maxfloat * confvar.DimWeight
+		percentage := "Topic" + strconv.Itoa(ranking.Topic) + " " + ranking.Label + ": "
+		percfloat := item.Proportion * m.config.DimWeight
 		strnumber := strconv.FormatFloat(percfloat, 'f', 3, 64)
 		percentage = percentage + strnumber + " percent"
-		resultstring2 := strings.Join([]string{resultstring1, resultsorted[maxindex].ID, percentage, resultsorted[maxindex].Text}, "\n")
-		resultsorted[maxindex].Value = float64(0)
+		resultstring2 := strings.Join([]string{resultstring1, item.ID, percentage, item.Text}, "\n")
 		results = append(results, resultstring2)
 	}
 	result := strings.Join(results, "\n")
-	fmt.Fprintf(w, result)
+	fmt.Fprint(w, result)
 }
 
-func renderTemplate(w http.ResponseWriter, tmpl string, p *Page) {
+func renderTemplate(w http.ResponseWriter, tmpl string, p interface{}) {
 	err := templates.ExecuteTemplate(w, tmpl+".html", p)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -671,31 +635,15 @@ func check(e error) {
 	}
 }
 
-func loadPage(info Info, address string) (*Page, error) {
+func loadPage(m *model, info Info, address string) (*Page, error) {
 	urn := info.URN
-	query := theta{}
-	if confvar.DB {
-		db, err := bolt.Open(dbname, 0644, nil)
-		check(err)
-		err = db.View(func(tx *bolt.Tx) error {
-			bucket := tx.Bucket([]byte("theta"))
-			if bucket == nil {
-				return fmt.Errorf("bucket %q not found", bucket)
-			}
-			val := bucket.Get([]byte(urn))
-			query, _ = gobDecode(val)
-			return nil
-		})
-		db.Close()
-	} else {
-		for _, v := range backend {
-			if v.ID == urn {
-				query = v
-				break
-			}
-		}
+	query, neighbors, nd, err := m.neighborsOf(urn, info)
+	if err != nil {
+		return nil, err
 	}
-	thetas, distances := calculateDistance(query, info.Count)
+	// The query goes first, as the center of the network.
+	thetas := append([]theta{query}, neighbors...)
+	distances := append([]float64{0}, nd...)
 	best := ""
 	text := ""
 
@@ -717,9 +665,9 @@ func loadPage(info Info, address string) (*Page, error) {
 			sortedIndiresult := reversesortresults(thetas[i].Vector, 3)
 			for j := range sortedIndiresult {
 				indiIndex := sortedIndiresult[j]
-				normed := thetas[i].Vector[indiIndex] * confvar.DimWeight
+				normed := thetas[i].Vector[indiIndex] * m.config.DimWeight
 				if normed > 5 {
-					beststring := "Topic" + strconv.Itoa(indiIndex+1) + " " + topics[indiIndex] + ": " + strconv.FormatFloat(normed, 'f', 2, 64) + "%" + "</br>"
+					beststring := "Topic" + strconv.Itoa(indiIndex+1) + " " + m.topicLabel(indiIndex) + ": " + strconv.FormatFloat(normed, 'f', 2, 64) + "%" + "</br>"
 					best = best + beststring
 				}
 			}
@@ -737,24 +685,24 @@ func loadPage(info Info, address string) (*Page, error) {
 			sortedIndiresult := reversesortresults(thetas[i].Vector, 3)
 			for j := range sortedIndiresult {
 				indiIndex := sortedIndiresult[j]
-				normed := thetas[i].Vector[indiIndex] * confvar.DimWeight
+				normed := thetas[i].Vector[indiIndex] * m.config.DimWeight
 				if normed > 5 {
-					beststring := "Topic" + strconv.Itoa(indiIndex+1) + " " + topics[indiIndex] + ": " + strconv.FormatFloat(normed, 'f', 2, 64) + "%" + "</br>"
+					beststring := "Topic" + strconv.Itoa(indiIndex+1) + " " + m.topicLabel(indiIndex) + ": " + strconv.FormatFloat(normed, 'f', 2, 64) + "%" + "</br>"
 					thebest = thebest + beststring
 				}
 			}
 			for j := range thetas[i].Vector {
 				topicdistance := mpair(thetas[i].Vector[j], query.Vector[j])
-				if topicdistance > significant {
-					topicdistance = topicdistance * confvar.DimWeight
-					signistring := "Distance Topic to " + strconv.Itoa(j+1) + " " + topics[j] + ": " + strconv.FormatFloat(topicdistance, 'f', 2, 64) + "%" + "</br>"
+				if topicdistance > m.config.Significance {
+					topicdistance = topicdistance * m.config.DimWeight
+					signistring := "Distance Topic to " + strconv.Itoa(j+1) + " " + m.topicLabel(j) + ": " + strconv.FormatFloat(topicdistance, 'f', 2, 64) + "%" + "</br>"
 					signi = signi + signistring
 				}
 			}
 			signis = append(signis, signi)
 			bests = append(bests, thebest)
-			xcord := float64(1) + float64(1)*distances[i] * confvar.VizWeight
-			ycord := float64(1) + float64(-1)*distances[i] * confvar.VizWeight
+			xcord := float64(1) + float64(1)*distances[i] * m.config.VizWeight
+			ycord := float64(1) + float64(-1)*distances[i] * m.config.VizWeight
 			var size float64
 			size = float64(1) * (float64(1) - distances[i])
 			resultNetwork.Nodes = append(resultNetwork.Nodes, Node{ID: thetas[i].ID, Label: thetas[i].ID, X: xcord, Y: ycord, Size: size})
@@ -764,7 +712,7 @@ func loadPage(info Info, address string) (*Page, error) {
 	}
 	networkJSON, _ := json.Marshal(resultNetwork)
 	stringJSON := template.JS(string(networkJSON))
-	distance := strconv.FormatFloat(significant, 'f', -1, 64)
+	distance := strconv.FormatFloat(m.config.Significance, 'f', -1, 64)
 	for i := range texts {
 		texts[i] = strings.Replace(texts[i], "\"", "'", -1)
 		texts[i] = "\"" + texts[i] + "\""
@@ -781,59 +729,61 @@ func loadPage(info Info, address string) (*Page, error) {
 	return &Page{URN: urn, Distance: distance, BestTopics: template.HTML(best), Text: text, Address: address, Port: port, JSON: stringJSON, JSTexts: template.JS(jScript), JSIDs: template.JS(jSIDs), JSDistance: template.JS(jsDistance), JSBest: template.JS(jsBest), JSSigni: template.JS(jsSigni)}, nil
 }
 
-func JsonResponse(info Info) (PassageJsonResponse, error) {
+func JsonResponse(m *model, info Info) (PassageJsonResponse, error) {
 	urn := info.URN
-	query := theta{}
-	if confvar.DB {
-		db, err := bolt.Open(dbname, 0644, nil)
-		check(err)
-		err = db.View(func(tx *bolt.Tx) error {
-			bucket := tx.Bucket([]byte("theta"))
-			if bucket == nil {
-				return fmt.Errorf("bucket %q not found", bucket)
-			}
-			val := bucket.Get([]byte(urn))
-			query, _ = gobDecode(val)
-			return nil
-		})
-		db.Close()
-	} else {
-		for _, v := range backend {
-			if v.ID == urn {
-				query = v
-				break
-			}
-		}
+	query, thetas, distances, err := m.neighborsOf(urn, info)
+	if err != nil {
+		return PassageJsonResponse{}, err
 	}
-	thetas, distances := calculateDistance(query, info.Count)
-	text := ""
+	return passageResponse(query, thetas, distances, info), nil
+}
+
+// passageResponse lists a query and its neighbors as JsonResponse does.
+func passageResponse(query theta, thetas []theta, distances []float64, info Info) PassageJsonResponse {
+	text := query.Text
 	var ids []string
 	var manhattans []string
 	var txts []string	// tgn fork
+	var metas []map[string]string
 
+	// The query itself is listed as rank 0 unless excludeSelf is set.
+	if !info.ExcludeSelf {
+		ids = append(ids, query.ID)
+		manhattans = append(manhattans, "0")
+		txts = append(txts, query.Text)  // tgn fork
+		metas = append(metas, query.Meta)
+	}
 	for i := range thetas {
-		switch {
-		case i == 0:
-			ids = append(ids, thetas[i].ID)
-			manhattans = append(manhattans, "0")
-			txts = append(txts, thetas[i].Text)  // tgn fork
-			text = thetas[i].Text
-		case i > 0:
-			mannormed := distances[i] * 100  // tgn fork (superficial)
-			mandist := strconv.FormatFloat(mannormed, 'f', 2, 64)
-			ids = append(ids, thetas[i].ID)
-			manhattans = append(manhattans, mandist)
-			txts = append(txts, thetas[i].Text)  // tgn fork
-		}
+		mannormed := distances[i] * 100  // tgn fork (superficial)
+		mandist := strconv.FormatFloat(mannormed, 'f', 2, 64)
+		ids = append(ids, thetas[i].ID)
+		manhattans = append(manhattans, mandist)
+		txts = append(txts, thetas[i].Text)  // tgn fork
+		metas = append(metas, thetas[i].Meta)
 	}
 
 	relatedItems := []relatedItem{}
+	offset := 0
+	if info.ExcludeSelf {
+		offset = 1
+	}
 	for i := range ids {
-		relatedItems = append(relatedItems, relatedItem{Id: ids[i], Rank: i, Distance: manhattans[i], Text: txts[i]})  // tgn fork
+		relatedItems = append(relatedItems, relatedItem{Id: ids[i], Rank: offset + i, Distance: manhattans[i], Text: txts[i], Meta: metas[i]})  // tgn fork
+	}
+
+	if info.Order == "citation" && len(relatedItems) > 1-offset {
+		neighbors := relatedItems[1-offset:]
+		keys := map[string]citationKey{}
+		for _, item := range neighbors {
+			keys[item.Id] = newCitationKey(item.Id)
+		}
+		sort.SliceStable(neighbors, func(i, j int) bool {
+			return compareKeys(keys[neighbors[i].Id], keys[neighbors[j].Id]) < 0
+		})
 	}
 
 	passageObject := PassageJsonResponse{URN: "test", Text: text, Items: relatedItems}
-	return passageObject, nil
+	return passageObject
 }
 
 type Network struct {
@@ -856,8 +806,18 @@ type Edge struct {
 }
 
 type Info struct {
-	URN   string
-	Count int
+	URN    string
+	Count  int
+	Metric DistanceMetric
+	Exact  bool
+	Scope  string               // "only" or "exclude" the query's own work
+	Order  string               // "citation" lists neighbors in citation order
+	Keep   func(id string) bool // if set, only passages it accepts are neighbors
+
+	ExcludeSelf     bool     // leave the query out of the results
+	ExcludePrefixes []string // leave out passages whose IDs start with these
+	Window          int      // leave out this many passages on either side of the query
+	MinDistance     float64  // leave out passages closer than this
 }
 
 type Page struct {
@@ -910,30 +870,6 @@ func jensenShannon(x, y []float64) float64 {
 	return result
 }
 
-func minIndexTheta(thetas []theta, topic int) (index int, floatvalue float64) {
-	index = 0
-	floatvalue = thetas[index].Vector[topic]
-	for i, e := range thetas {
-		if e.Vector[topic] < floatvalue {
-			index = i
-			floatvalue = e.Vector[topic]
-		}
-	}
-	return
-}
-
-func maxIndexTheta(resultsorted []ptopic) (index int, floatvalue float64) {
-	index = 0
-	floatvalue = resultsorted[index].Value
-	for i, v := range resultsorted {
-		if v.Value > floatvalue {
-			index = i
-			floatvalue = v.Value
-		}
-	}
-	return
-}
-
 func manhattan_wghted(x, y, weight []float64) float64 {
 	var result float64
 	for i := range x {
@@ -954,97 +890,25 @@ func maxIndexDistance(distances []float64) (index int, floatvalue float64) {
 	return
 }
 
-type dataframe struct {
-	Thetas    []theta
-	Distances []float64
-}
-
-func (m dataframe) Len() int           { return len(m.Distances) }
-func (m dataframe) Less(i, j int) bool { return m.Distances[i] < m.Distances[j] }
-func (m dataframe) Swap(i, j int) {
-	m.Thetas[i], m.Thetas[j] = m.Thetas[j], m.Thetas[i]
-	m.Distances[i], m.Distances[j] = m.Distances[j], m.Distances[i]
-}
-
-func calculateDistance(query theta, count int) ([]theta, []float64) {
-	thetas := make([]theta, count+1)
-	distances := make([]float64, count+1)
-	if confvar.DB {
-		db, err := bolt.Open(dbname, 0644, nil)
-		if err != nil {
-			log.Fatal(err)
+func (m *model) calculateDistance(query theta, info Info) ([]theta, []float64) {
+	best := newTopK(info.Count+1, false)
+	distanceTo := func(id string, vector []float64) float64 { return info.Metric.Distance(query.Vector, vector) }
+	if pm, ok := info.Metric.(projectedMetric); ok {
+		distanceTo = pm.distanceTo(query.Vector)
+	}
+	m.store.Vectors(func(id string, vector []float64) error {
+		if info.Keep != nil && !info.Keep(id) {
+			return nil
 		}
-		defer db.Close()
-		db.View(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte("theta"))
-
-			c := b.Cursor()
-			indexcount := 0
-
-			for k, v := c.First(); k != nil; k, v = c.Next() {
-				newtheta, err := gobDecode(v)
-				if err != nil {
-					log.Println("decoding problem")
-				}
-				if indexcount <= count {
-					thetas[indexcount] = newtheta
-					switch distance {
-					case "jsd":
-						distances[indexcount] = jensenShannon(query.Vector, newtheta.Vector)
-					default:
-						distances[indexcount] = manhattan(query.Vector, newtheta.Vector)
-					}
-					indexcount++
-					continue
-				}
-				maxindex, maxfloat := maxIndexDistance(distances)
-				var newdistance float64
-				switch distance {
-				case "jsd":
-					newdistance = jensenShannon(query.Vector, newtheta.Vector)
-				default:
-					newdistance = manhattan(query.Vector, newtheta.Vector)
-				}
-				if newdistance < maxfloat {
-					thetas[maxindex] = newtheta
-					distances[maxindex] = newdistance
-				}
-			}
+		distance := distanceTo(id, vector)
+		if distance < info.MinDistance {
 			return nil
-		})
-		sort.Sort(dataframe{Thetas: thetas, Distances: distances})
-		return thetas, distances
-	} else {
-		indexcount := 0
-		for _, v := range backend {
-			newtheta := v
-			if indexcount <= count {
-				thetas[indexcount] = newtheta
-				switch distance {
-				case "jsd":
-					distances[indexcount] = jensenShannon(query.Vector, newtheta.Vector)
-				default:
-					distances[indexcount] = manhattan(query.Vector, newtheta.Vector)
-				}
-				indexcount++
-				continue
-			}
-			maxindex, maxfloat := maxIndexDistance(distances)
-			var newdistance float64
-			switch distance {
-			case "jsd":
-				newdistance = jensenShannon(query.Vector, newtheta.Vector)
-			default:
-				newdistance = manhattan(query.Vector, newtheta.Vector)
-			}
-			if newdistance < maxfloat {
-				thetas[maxindex] = newtheta
-				distances[maxindex] = newdistance
-			}
 		}
-		sort.Sort(dataframe{Thetas: thetas, Distances: distances})
-		return thetas, distances
-	}
+		best.Offer(theta{ID: id, Vector: vector}, distance)
+		return nil
+	})
+	thetas, distances := best.Sorted()
+	return m.withTexts(thetas), distances
 }
 
 func sortresults(result []float64, number int) []float64 {
@@ -1125,4 +989,6 @@ type relatedItem struct {
 	Rank		 int	  `json:"rank"`  // tgn fork
 	Distance string `json:"distance"`
 	Text		 string `json:"text"`  // tgn fork
+	Meta     map[string]string `json:"meta,omitempty"`
+	Contributions []contribution `json:"contributions,omitempty"` // centroid queries
 }
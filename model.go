@@ -0,0 +1,455 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// model is one loaded topic model run: the configuration it was loaded
+// with, its passages and the search structures built over them.
+type model struct {
+	config     serverConfig
+	store      ThetaStore
+	index      *vpTree
+	metric     DistanceMetric
+	work       func(id string) string       // the work a passage belongs to
+	meta       map[string]map[string]string // passage metadata, for filters
+	words      *topicWords                  // topic-word weights, if configured
+	labels     *labelStore
+	projection *topicProjection // masked and merged topics, if configured
+
+	positionsOnce   sync.Once
+	sequence        map[string]int // see positions
+	prevalenceOnce  sync.Once
+	topicPrevalence []float64 // see prevalence
+	statsMu         sync.Mutex
+	stats           map[string]*topicStats // by work and threshold
+	users           sync.WaitGroup         // requests and jobs still using the model
+}
+
+// defaultModelName names the model of a config.json without a models list.
+const defaultModelName = "default"
+
+var (
+	models     = map[string]*model{}
+	modelNames []string // in config order; the first one is the default
+	modelsMu   sync.RWMutex
+	reloadMu   sync.Mutex
+)
+
+// acquireModel returns the named model, or the default one for an empty
+// name, together with the function that releases it. A reload swaps in new
+// models right away but closes the old ones only once every holder has
+// released them, so a request sees one consistent model throughout.
+func acquireModel(name string) (*model, func(), bool) {
+	acquired, release, err := acquireModels(name)
+	if err != nil {
+		return nil, release, false
+	}
+	return acquired[0], release, true
+}
+
+// acquireModels is acquireModel for several models at once; they all come
+// from the same generation, even if a reload happens meanwhile.
+func acquireModels(names ...string) ([]*model, func(), error) {
+	modelsMu.RLock()
+	defer modelsMu.RUnlock()
+	acquired := make([]*model, len(names))
+	for i, name := range names {
+		if name == "" && len(modelNames) > 0 {
+			name = modelNames[0]
+		}
+		m, ok := models[name]
+		if !ok {
+			return nil, func() {}, fmt.Errorf("no such model %q", name)
+		}
+		acquired[i] = m
+	}
+	for _, m := range acquired {
+		m.users.Add(1)
+	}
+	return acquired, func() {
+		for _, m := range acquired {
+			m.users.Done()
+		}
+	}, nil
+}
+
+// modelFromRequest acquires the model named by the {model} route variable.
+// Routes without one get the default model. It answers 404 itself and
+// returns nil if there is no such model.
+func modelFromRequest(w http.ResponseWriter, r *http.Request) (*model, func()) {
+	name := mux.Vars(r)["model"]
+	m, release, ok := acquireModel(name)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no such model %q", name), http.StatusNotFound)
+		return nil, release
+	}
+	return m, release
+}
+
+// pageBase is where the pages of the model a request addresses live, so
+// that links between them stay on that model.
+func pageBase(m *model, r *http.Request) string {
+	if name := mux.Vars(r)["model"]; name != "" {
+		return m.config.Host + "/models/" + url.PathEscape(name)
+	}
+	return m.config.Host
+}
+
+// modelConfigs expands the models list of config.json. Each entry is read
+// on top of the top-level settings, so it only needs to name what differs.
+// Without a list, the top-level settings describe a single default model
+// stored in metallo.db.
+func modelConfigs(conf serverConfig) ([]serverConfig, error) {
+	base := conf
+	base.Models = nil
+	if len(conf.Models) == 0 {
+		if base.Name == "" {
+			base.Name = defaultModelName
+		}
+		if base.DBPath == "" {
+			base.DBPath = dbname
+		}
+		if base.LabelPath == "" {
+			base.LabelPath = filepath.Join(pwd, "labels.json")
+		}
+		return []serverConfig{base}, nil
+	}
+	var result []serverConfig
+	names := map[string]bool{}
+	paths := map[string]string{}
+	for i, raw := range conf.Models {
+		c := base
+		c.Name, c.DBPath, c.LabelPath = "", "", ""
+		c.Weights = append([]float64(nil), base.Weights...)
+		if err := json.Unmarshal(raw, &c); err != nil {
+			return nil, fmt.Errorf("models[%d]: %v", i, err)
+		}
+		switch {
+		case c.Name == "":
+			return nil, fmt.Errorf("models[%d] has no name", i)
+		case strings.Contains(c.Name, "/"):
+			return nil, fmt.Errorf("model name %q contains a slash", c.Name)
+		case names[c.Name]:
+			return nil, fmt.Errorf("model %q is declared twice", c.Name)
+		}
+		names[c.Name] = true
+		if c.DBPath == "" {
+			c.DBPath = filepath.Join(pwd, "metallo-"+c.Name+".db")
+		}
+		if c.LabelPath == "" {
+			c.LabelPath = filepath.Join(pwd, "labels-"+c.Name+".json")
+		}
+		if c.DB {
+			if other, ok := paths[c.DBPath]; ok {
+				return nil, fmt.Errorf("models %q and %q share the db %s", other, c.Name, c.DBPath)
+			}
+			paths[c.DBPath] = c.Name
+		}
+		result = append(result, c)
+	}
+	return result, nil
+}
+
+type loadOptions struct {
+	rebuild bool // re-read the theta source into a fresh bolt store
+	migrate bool // convert an older bolt store first
+	staging bool // build next to the configured db, for a reload
+}
+
+// dbPath is where the model's bolt store is opened.
+func (opts loadOptions) dbPath(conf serverConfig) string {
+	if opts.staging {
+		return conf.DBPath + ".reload"
+	}
+	return conf.DBPath
+}
+
+// loadModels loads every model declared in conf. If one fails, those
+// loaded already are closed again.
+func loadModels(conf serverConfig, opts loadOptions) (map[string]*model, []string, error) {
+	configs, err := modelConfigs(conf)
+	if err != nil {
+		return nil, nil, err
+	}
+	loaded := map[string]*model{}
+	var names []string
+	for _, c := range configs {
+		m, err := loadModel(c, opts)
+		if err != nil {
+			for _, m := range loaded {
+				m.close()
+			}
+			return nil, nil, fmt.Errorf("model %s: %v", c.Name, err)
+		}
+		loaded[c.Name] = m
+		names = append(names, c.Name)
+	}
+	return loaded, names, nil
+}
+
+// loadModel reads the theta data described by conf, either into memory or
+// into/from a bolt store, and builds the configured index.
+func loadModel(conf serverConfig, opts loadOptions) (*model, error) {
+	log.Printf("Loading model %s from %s...", conf.Name, conf.Source)
+	m := &model{config: conf}
+	work, err := newWorkRule(conf)
+	if err != nil {
+		return nil, err
+	}
+	m.work = work
+	if conf.DB {
+		dbpath := opts.dbPath(conf)
+		if opts.rebuild || opts.staging {
+			os.Remove(dbpath)
+		} else if opts.migrate {
+			log.Println("Migrating the db...")
+			if err := migrateDB(dbpath, conf); err != nil {
+				return nil, err
+			}
+		}
+		db, err := openBoltStore(dbpath, dbTimeout(conf))
+		if err != nil {
+			return nil, err
+		}
+		if opts.rebuild || opts.staging {
+			log.Println("(Re-)building the db...")
+			err = db.initSchema()
+			if err == nil {
+				err = readTheta(conf, db)
+			}
+			if err != nil {
+				db.Close()
+				os.Remove(dbpath)
+				return nil, err
+			}
+		} else {
+			log.Println("Starting without re-building the db...")
+			err = db.checkSchema()
+			if err == nil {
+				err = db.loadTopics()
+			}
+			if err != nil {
+				db.Close()
+				return nil, err
+			}
+		}
+		m.store = db
+	} else {
+		log.Println("Starting without a database. Keeping it all in memory...")
+		thetas, topics, err := readThetaNoDB(conf)
+		if err != nil {
+			return nil, err
+		}
+		m.store = newMemoryStore(thetas, topics)
+	}
+	if m.meta, err = m.store.Metadata(); err != nil {
+		m.store.Close()
+		return nil, err
+	}
+	if len(m.meta) > 0 {
+		log.Printf("Metadata for %d passages.", len(m.meta))
+	}
+	if m.labels, err = openLabelStore(conf.LabelPath); err != nil {
+		m.store.Close()
+		return nil, err
+	}
+	if conf.TopicWordSource != "" {
+		if m.words, err = readTopicWords(conf, len(m.store.Topics())); err != nil {
+			m.store.Close()
+			return nil, err
+		}
+	}
+	if m.projection, err = m.configuredProjection(); err != nil {
+		m.store.Close()
+		return nil, err
+	}
+	if m.projection != nil {
+		m.cacheProjection()
+	}
+	m.metric = m.projectMetric(m.configuredMetric(), m.projection)
+	log.Println("Default distance metric:", m.metric.Name())
+	if conf.Index {
+		m.buildIndex()
+	}
+	return m, nil
+}
+
+// close waits for the model's remaining users and closes its store.
+func (m *model) close() {
+	m.users.Wait()
+	if err := m.store.Close(); err != nil {
+		log.Println("closing db:", err)
+	}
+}
+
+// withTexts completes passages found by a vector scan with their texts.
+func (m *model) withTexts(thetas []theta) []theta {
+	for i := range thetas {
+		if full, err := m.store.Get(thetas[i].ID); err == nil {
+			thetas[i] = full
+		}
+	}
+	return thetas
+}
+
+// closeModels closes the stores of all models in service.
+func closeModels() {
+	modelsMu.Lock()
+	defer modelsMu.Unlock()
+	for _, m := range models {
+		m.close()
+	}
+}
+
+// reload re-reads config.json and the theta sources into new models and
+// swaps them in once all are complete. If anything fails, the old models
+// stay in service. In DB mode each new store is built next to the old one
+// and replaces it after the swap.
+func reload() ([]string, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	start := time.Now()
+	conf, err := readConfiguration("config.json")
+	if err != nil {
+		return nil, err
+	}
+	if conf.Port != port {
+		log.Println("The port changed to", conf.Port, "- that takes a restart.")
+	}
+	opts := loadOptions{staging: true}
+	loaded, names, err := loadModels(conf, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	modelsMu.Lock()
+	old := models
+	models, modelNames = loaded, names
+	confvar = conf
+	modelsMu.Unlock()
+
+	// Old stores stay open, on their now unlinked files, until their
+	// last requests and jobs are done.
+	for _, name := range names {
+		m := loaded[name]
+		if !m.config.DB {
+			continue
+		}
+		if err := os.Rename(opts.dbPath(m.config), m.config.DBPath); err != nil {
+			log.Println("keeping the new db at", opts.dbPath(m.config)+":", err)
+		}
+	}
+	for _, m := range old {
+		go m.close()
+	}
+	log.Printf("Reloaded %d model(s) in %v.", len(names), time.Since(start))
+	return names, nil
+}
+
+// adminToken is the adminToken of the current configuration.
+func adminToken() string {
+	modelsMu.RLock()
+	defer modelsMu.RUnlock()
+	return confvar.AdminToken
+}
+
+// adminAuthorized checks that a request carries the configured admin token
+// in X-Admin-Token and answers 403 if not. Without a configured token no
+// request is authorized.
+func adminAuthorized(w http.ResponseWriter, r *http.Request, action string) bool {
+	token := adminToken()
+	given := r.Header.Get("X-Admin-Token")
+	if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		http.Error(w, action+" needs the adminToken of config.json in an X-Admin-Token header", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// AdminReload triggers a reload. The request has to carry the adminToken
+// of config.json in an X-Admin-Token header; without one, reloading is
+// left to SIGHUP.
+func AdminReload(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(w, r, "reloading") {
+		return
+	}
+	names, err := reload()
+	if err != nil {
+		log.Println("reload failed, still serving the old data:", err)
+		http.Error(w, fmt.Sprintf("reload failed, still serving the old data: %v", err), http.StatusInternalServerError)
+		return
+	}
+	result, _ := json.Marshal(map[string]interface{}{
+		"status": "reloaded",
+		"models": names,
+	})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintln(w, string(result))
+}
+
+// reloadOnHangup reloads whenever the process receives SIGHUP.
+func reloadOnHangup() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		log.Println("Received SIGHUP - reloading...")
+		if _, err := reload(); err != nil {
+			log.Println("reload failed, still serving the old data:", err)
+		}
+	}
+}
+
+type modelListing struct {
+	Name     string `json:"name"`
+	Default  bool   `json:"default"`
+	Source   string `json:"source"`
+	Format   string `json:"format,omitempty"`
+	Passages int    `json:"passages"`
+	Topics   int    `json:"topics"`
+	Distance string `json:"distance"`
+	DB       string `json:"db,omitempty"`
+	Indexed  bool   `json:"indexed"`
+}
+
+// ListModels describes the models in service, default first.
+func ListModels(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	modelsMu.RLock()
+	listing := []modelListing{}
+	for i, name := range modelNames {
+		m := models[name]
+		entry := modelListing{
+			Name:     name,
+			Default:  i == 0,
+			Source:   m.config.Source,
+			Format:   m.config.Format,
+			Passages: m.store.Count(),
+			Topics:   len(m.store.Topics()),
+			Distance: m.metric.Name(),
+			Indexed:  m.index != nil,
+		}
+		if m.config.DB {
+			entry.DB = m.config.DBPath
+		}
+		listing = append(listing, entry)
+	}
+	modelsMu.RUnlock()
+	result, _ := json.Marshal(listing)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintln(w, string(result))
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// topicProjection hides junk topics and merges related ones before
+// passages are compared or ranked. Each remaining group of topics becomes
+// one dimension holding the sum of its members, and the result is
+// renormalized so the mass of masked topics is spread over the rest.
+// Topics are numbered from 1 in configuration and requests (maskTopics,
+// mergeTopics; ?mask=3,7 and ?merge=1,2, one group per merge value).
+type topicProjection struct {
+	groups  [][]int // topic indexes, from 0, of each dimension
+	group   []int   // dimension of each topic, or -1 if masked
+	desc    string
+	vectors map[string][]float64 // projected stored vectors, see cacheProjection
+}
+
+// newTopicProjection checks mask and merge against k topics. It returns
+// nil if there is nothing to project.
+func newTopicProjection(k int, mask []int, merge [][]int) (*topicProjection, error) {
+	if len(mask) == 0 && len(merge) == 0 {
+		return nil, nil
+	}
+	p := &topicProjection{group: make([]int, k)}
+	seen := make([]string, k)
+	use := func(topic int, as string) (int, error) {
+		if topic < 1 || topic > k {
+			return 0, fmt.Errorf("topic %d out of range 1-%d", topic, k)
+		}
+		if seen[topic-1] == as {
+			return 0, fmt.Errorf("topic %d is %s twice", topic, as)
+		}
+		if seen[topic-1] != "" {
+			return 0, fmt.Errorf("topic %d is %s and %s", topic, seen[topic-1], as)
+		}
+		seen[topic-1] = as
+		return topic - 1, nil
+	}
+	for _, topic := range mask {
+		if _, err := use(topic, "masked"); err != nil {
+			return nil, err
+		}
+	}
+	merged := map[int][]int{} // by smallest member
+	for _, members := range merge {
+		if len(members) < 2 {
+			return nil, fmt.Errorf("a merged group needs at least two topics")
+		}
+		var group []int
+		for _, topic := range members {
+			t, err := use(topic, "merged")
+			if err != nil {
+				return nil, err
+			}
+			group = append(group, t)
+		}
+		sort.Ints(group)
+		merged[group[0]] = group
+	}
+	var parts []string
+	if len(mask) > 0 {
+		parts = append(parts, "mask "+joinTopics(mask, ","))
+	}
+	for t := 0; t < k; t++ {
+		switch {
+		case seen[t] == "":
+			p.groups = append(p.groups, []int{t})
+		case merged[t] != nil:
+			p.groups = append(p.groups, merged[t])
+			var numbers []int
+			for _, member := range merged[t] {
+				numbers = append(numbers, member+1)
+			}
+			parts = append(parts, "merge "+joinTopics(numbers, "+"))
+		}
+	}
+	if len(p.groups) == 0 {
+		return nil, fmt.Errorf("every topic is masked")
+	}
+	for t := range p.group {
+		p.group[t] = -1
+	}
+	for g, members := range p.groups {
+		for _, t := range members {
+			p.group[t] = g
+		}
+	}
+	p.desc = strings.Join(parts, "; ")
+	return p, nil
+}
+
+func joinTopics(topics []int, sep string) string {
+	s := make([]string, len(topics))
+	for i, t := range topics {
+		s[i] = strconv.Itoa(t)
+	}
+	return strings.Join(s, sep)
+}
+
+// project maps a topic vector to the groups and renormalizes it.
+func (p *topicProjection) project(vector []float64) []float64 {
+	return p.projectInto(nil, vector)
+}
+
+// projectInto is project writing into dst, which is reused if it has room.
+func (p *topicProjection) projectInto(dst, vector []float64) []float64 {
+	if cap(dst) < len(p.groups) {
+		dst = make([]float64, len(p.groups))
+	}
+	result := dst[:len(p.groups)]
+	var sum float64
+	for g, members := range p.groups {
+		result[g] = 0
+		for _, t := range members {
+			if t < len(vector) {
+				result[g] += vector[t]
+			}
+		}
+		sum += result[g]
+	}
+	if sum > 0 {
+		for g := range result {
+			result[g] /= sum
+		}
+	}
+	return result
+}
+
+// projectAll projects passages for the divergence exports, leaving the
+// stored vectors alone.
+func (p *topicProjection) projectAll(thetas []theta) []theta {
+	result := make([]theta, len(thetas))
+	for i, t := range thetas {
+		result[i] = theta{ID: t.ID, Text: t.Text, Vector: p.stored(t.ID, t.Vector, nil), Meta: t.Meta}
+	}
+	return result
+}
+
+// stored projects the stored vector of passage id, from the cache if the
+// projection has one and otherwise into buf.
+func (p *topicProjection) stored(id string, vector, buf []float64) []float64 {
+	if projected, ok := p.vectors[id]; ok {
+		return projected
+	}
+	return p.projectInto(buf, vector)
+}
+
+// cacheProjection projects the stored vectors once for the configured
+// projection, which every default query goes through.
+func (m *model) cacheProjection() {
+	p := m.projection
+	p.vectors = map[string][]float64{}
+	m.store.Vectors(func(id string, vector []float64) error {
+		p.vectors[id] = p.project(vector)
+		return nil
+	})
+}
+
+// share is the projected proportion of the group topic (from 0) belongs
+// to, which is what topic rankings sort by.
+func (p *topicProjection) share(vector []float64, topic int) float64 {
+	var part, sum float64
+	for t, v := range vector {
+		if t >= len(p.group) || p.group[t] < 0 {
+			continue
+		}
+		if p.group[t] == p.group[topic] {
+			part += v
+		}
+		sum += v
+	}
+	if sum == 0 {
+		return 0
+	}
+	return part / sum
+}
+
+// projectedMetric compares passages after projecting them. The weights of
+// the weighted Manhattan metric are averaged over each group.
+type projectedMetric struct {
+	metric     DistanceMetric
+	projection *topicProjection
+}
+
+func (m *model) projectMetric(metric DistanceMetric, p *topicProjection) DistanceMetric {
+	if p == nil {
+		return metric
+	}
+	if weighted, ok := metric.(weightedManhattanMetric); ok {
+		weights := make([]float64, len(p.groups))
+		for g, members := range p.groups {
+			for _, t := range members {
+				if t < len(weighted.weights) {
+					weights[g] += weighted.weights[t]
+				} else {
+					weights[g]++
+				}
+			}
+			weights[g] /= float64(len(members))
+		}
+		metric = weightedManhattanMetric{weights: weights}
+	}
+	return projectedMetric{metric: metric, projection: p}
+}
+
+func (pm projectedMetric) Name() string {
+	return pm.metric.Name() + " (" + pm.projection.desc + ")"
+}
+
+func (pm projectedMetric) Distance(x, y []float64) float64 {
+	return pm.metric.Distance(pm.projection.project(x), pm.projection.project(y))
+}
+
+// distanceTo is Distance for a scan over the stored passages: the query is
+// projected once and the passages come from the cache or a reused buffer.
+func (pm projectedMetric) distanceTo(query []float64) func(id string, vector []float64) float64 {
+	point := pm.projection.project(query)
+	buf := make([]float64, len(point))
+	return func(id string, vector []float64) float64 {
+		return pm.metric.Distance(point, pm.projection.stored(id, vector, buf))
+	}
+}
+
+// configuredProjection builds the projection of maskTopics and mergeTopics.
+func (m *model) configuredProjection() (*topicProjection, error) {
+	p, err := newTopicProjection(len(m.store.Topics()), m.config.MaskTopics, m.config.MergeTopics)
+	if err != nil {
+		return nil, fmt.Errorf("maskTopics/mergeTopics: %v", err)
+	}
+	return p, nil
+}
+
+// projectionFromRequest honours ?mask= and ?merge=, which replace the
+// configured ones; "none" drops them.
+func (m *model) projectionFromRequest(r *http.Request) (*topicProjection, error) {
+	query := r.URL.Query()
+	_, hasMask := query["mask"]
+	_, hasMerge := query["merge"]
+	if !hasMask && !hasMerge {
+		return m.projection, nil
+	}
+	mask, merge := m.config.MaskTopics, m.config.MergeTopics
+	if hasMask {
+		mask = nil
+		for _, v := range query["mask"] {
+			topics, err := parseTopicList(v)
+			if err != nil {
+				return nil, fmt.Errorf("mask: %v", err)
+			}
+			mask = append(mask, topics...)
+		}
+	}
+	if hasMerge {
+		merge = nil
+		for _, v := range query["merge"] {
+			topics, err := parseTopicList(v)
+			if err != nil {
+				return nil, fmt.Errorf("merge: %v", err)
+			}
+			if topics != nil {
+				merge = append(merge, topics)
+			}
+		}
+	}
+	return newTopicProjection(len(m.store.Topics()), mask, merge)
+}
+
+// parseTopicList reads comma-separated topic numbers; "none" is no topics.
+func parseTopicList(v string) ([]int, error) {
+	if v == "none" || v == "" {
+		return nil, nil
+	}
+	var topics []int
+	for _, field := range strings.Split(v, ",") {
+		topic, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a topic number", field)
+		}
+		topics = append(topics, topic)
+	}
+	return topics, nil
+}
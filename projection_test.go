@@ -0,0 +1,120 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestNewTopicProjectionErrors(t *testing.T) {
+	cases := []struct {
+		mask  []int
+		merge [][]int
+	}{
+		{[]int{0}, nil},
+		{[]int{5}, nil},
+		{[]int{2, 2}, nil},
+		{nil, [][]int{{1}}},
+		{nil, [][]int{{1, 2}, {2, 3}}},
+		{[]int{1}, [][]int{{1, 2}}},
+		{[]int{1, 2, 3, 4}, nil},
+	}
+	for _, c := range cases {
+		if _, err := newTopicProjection(4, c.mask, c.merge); err == nil {
+			t.Errorf("mask %v, merge %v: no error", c.mask, c.merge)
+		}
+	}
+	if p, err := newTopicProjection(4, nil, nil); p != nil || err != nil {
+		t.Errorf("nothing to project gave %v, %v", p, err)
+	}
+}
+
+func TestProject(t *testing.T) {
+	p, err := newTopicProjection(5, []int{2}, [][]int{{5, 4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]int{{0}, {2}, {3, 4}}; !reflect.DeepEqual(p.groups, want) {
+		t.Errorf("groups %v, want %v", p.groups, want)
+	}
+	if p.desc != "mask 2; merge 4+5" {
+		t.Errorf("described as %q", p.desc)
+	}
+	got := p.project([]float64{0.1, 0.5, 0.2, 0.1, 0.1})
+	want := []float64{0.2, 0.4, 0.4} // the masked 0.5 spread over the rest
+	for i := range want {
+		if math.Abs(got[i]-want[i]) > 1e-12 {
+			t.Fatalf("projected to %v, want %v", got, want)
+		}
+	}
+	vector := []float64{0.1, 0.5, 0.2, 0.1, 0.1}
+	for topic, share := range map[int]float64{0: 0.2, 2: 0.4, 3: 0.4, 4: 0.4} {
+		if got := p.share(vector, topic); math.Abs(got-share) > 1e-12 {
+			t.Errorf("share of topic %d = %v, want %v", topic+1, got, share)
+		}
+	}
+	if got := p.project([]float64{0, 1, 0, 0, 0}); !reflect.DeepEqual(got, []float64{0, 0, 0}) {
+		t.Errorf("a vector of masked topics only projected to %v", got)
+	}
+}
+
+func TestProjectMetricWeights(t *testing.T) {
+	p, _ := newTopicProjection(4, []int{1}, [][]int{{2, 3}})
+	m := &model{}
+	metric := m.projectMetric(weightedManhattanMetric{weights: []float64{1, 2, 4, 6}}, p)
+	inner := metric.(projectedMetric).metric.(weightedManhattanMetric)
+	// Topics 2 and 3 average to 3; topic 4 keeps its 6.
+	if want := []float64{3, 6}; !reflect.DeepEqual(inner.weights, want) {
+		t.Errorf("projected weights %v, want %v", inner.weights, want)
+	}
+	if m.projectMetric(manhattanMetric{}, nil) != (manhattanMetric{}) {
+		t.Error("no projection changed the metric")
+	}
+}
+
+func TestParseTopicList(t *testing.T) {
+	if got, err := parseTopicList("3, 7,1"); err != nil || !reflect.DeepEqual(got, []int{3, 7, 1}) {
+		t.Errorf("got %v, %v", got, err)
+	}
+	if got, err := parseTopicList("none"); got != nil || err != nil {
+		t.Errorf("none gave %v, %v", got, err)
+	}
+	if _, err := parseTopicList("3,x"); err == nil {
+		t.Error("accepted a non-number")
+	}
+}
+
+// The index over projected vectors finds what a projected scan finds.
+func TestProjectedIndex(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	var thetas []theta
+	for i := 0; i < 200; i++ {
+		vector := make([]float64, 6)
+		for k := range vector {
+			vector[k] = rnd.Float64()
+		}
+		thetas = append(thetas, theta{ID: strconv.Itoa(i), Vector: normalized(vector)})
+	}
+	m := &model{store: newMemoryStore(thetas, make([]string, 6)), config: serverConfig{MaskTopics: []int{2}, MergeTopics: [][]int{{4, 6}}}}
+	var err error
+	if m.projection, err = m.configuredProjection(); err != nil {
+		t.Fatal(err)
+	}
+	m.cacheProjection()
+	m.metric = m.projectMetric(jsdMetric{}, m.projection)
+	m.buildIndex()
+	if m.index == nil {
+		t.Fatal("no index under a projection")
+	}
+	for _, query := range thetas[:20] {
+		indexed, indexDistances := m.nearestNeighbors(query, Info{Count: 5, Metric: m.metric})
+		scanned, scanDistances := m.nearestNeighbors(query, Info{Count: 5, Metric: m.metric, Exact: true})
+		for i := range scanned {
+			if indexed[i].ID != scanned[i].ID || math.Abs(indexDistances[i]-scanDistances[i]) > 1e-12 {
+				t.Fatalf("query %s: index found %s at %v, scan %s at %v", query.ID, indexed[i].ID, indexDistances[i], scanned[i].ID, scanDistances[i])
+			}
+		}
+	}
+}
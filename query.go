@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Values of the ?work= query option.
+const (
+	workScopeOnly    = "only"    // neighbors from the query's own work
+	workScopeExclude = "exclude" // neighbors from other works
+)
+
+// infoFromRequest reads a neighbor query from the route variables {urn}
+// and {count} and these options:
+//
+//	metric=NAME         distance metric other than the model's default
+//	exact=true          scan all passages even if there is an index
+//	work=only|exclude   keep to or leave out the query's own work
+//	order=citation      list neighbors in citation order rather than by rank
+//	excludeSelf=true    leave the query passage out of the results
+//	excludePrefix=P     leave out passages whose IDs start with P; repeatable
+//	window=N            leave out the N passages before and after the query
+//	minDistance=D       leave out passages closer than D, in metric units
+//	filter=F            keep to passages whose metadata match F, such as
+//	                    author:Dharmakirti or century<8; repeatable
+func infoFromRequest(m *model, r *http.Request) (Info, error) {
+	vars := mux.Vars(r)
+	query := r.URL.Query()
+	count, _ := strconv.Atoi(vars["count"])
+	metric, err := m.metricFromRequest(r)
+	if err != nil {
+		return Info{}, err
+	}
+	info := Info{
+		URN:             vars["urn"],
+		Count:           count,
+		Metric:          metric,
+		Exact:           query.Get("exact") == "true",
+		Scope:           query.Get("work"),
+		Order:           query.Get("order"),
+		ExcludeSelf:     query.Get("excludeSelf") == "true",
+		ExcludePrefixes: query["excludePrefix"]}
+	switch info.Scope {
+	case "", workScopeOnly, workScopeExclude:
+	default:
+		return info, fmt.Errorf("work must be %q or %q", workScopeOnly, workScopeExclude)
+	}
+	switch info.Order {
+	case "", "rank", "citation":
+	default:
+		return info, fmt.Errorf("order must be rank or citation")
+	}
+	if v := query.Get("window"); v != "" {
+		info.Window, err = strconv.Atoi(v)
+		if err != nil || info.Window < 0 {
+			return info, fmt.Errorf("window must be a number of passages")
+		}
+	}
+	if v := query.Get("minDistance"); v != "" {
+		info.MinDistance, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return info, fmt.Errorf("minDistance must be a number")
+		}
+	}
+	info.Keep, err = m.metaFilters(query["filter"])
+	return info, err
+}
+
+// neighborsOf resolves urn and finds up to info.Count of its neighbors,
+// nearest first, leaving out the query itself and whatever the options in
+// info exclude. For a work or range query the query is the centroid of its
+// passages, which are left out as well.
+func (m *model) neighborsOf(urn string, info Info) (theta, []theta, []float64, error) {
+	query, members, err := m.resolveQuery(urn)
+	if err != nil {
+		return query, nil, nil, err
+	}
+	if members == nil {
+		members = []string{query.ID}
+	}
+	neighbors, distances := m.searchNear(query, members, info)
+	return query, neighbors, distances, nil
+}
+
+// searchNear finds up to info.Count neighbors of query other than itself
+// and its members, honoring the exclusions in info.
+func (m *model) searchNear(query theta, members []string, info Info) ([]theta, []float64) {
+	info.Keep = m.exclusions(info, members)
+	thetas, distances := m.nearestNeighbors(query, info)
+	var neighbors []theta
+	var nd []float64
+	for i, t := range thetas {
+		if t.ID != query.ID && len(neighbors) < info.Count {
+			neighbors = append(neighbors, t)
+			nd = append(nd, distances[i])
+		}
+	}
+	return neighbors, nd
+}
+
+// exclusions combines info.Keep with the filters the query options ask
+// for. members are the passages the query stands for. It returns nil if
+// nothing is excluded, so that the index can still be used.
+func (m *model) exclusions(info Info, members []string) func(id string) bool {
+	var filters []func(id string) bool
+	if info.Keep != nil {
+		filters = append(filters, info.Keep)
+	}
+	if len(members) > 1 {
+		inQuery := map[string]bool{}
+		for _, id := range members {
+			inQuery[id] = true
+		}
+		filters = append(filters, func(id string) bool { return !inQuery[id] })
+	}
+	work := m.work(info.URN)
+	if info.Scope != "" {
+		only := info.Scope == workScopeOnly
+		filters = append(filters, func(id string) bool { return (m.work(id) == work) == only })
+	}
+	if len(info.ExcludePrefixes) > 0 {
+		filters = append(filters, func(id string) bool {
+			for _, prefix := range info.ExcludePrefixes {
+				if prefix != "" && strings.HasPrefix(id, prefix) {
+					return false
+				}
+			}
+			return true
+		})
+	}
+	if info.Window > 0 {
+		positions := m.positions()
+		first, last := -1, -1
+		for _, id := range members {
+			if p, ok := positions[id]; ok {
+				if first < 0 || p < first {
+					first = p
+				}
+				if p > last {
+					last = p
+				}
+			}
+		}
+		if first >= 0 {
+			work := m.work(members[0])
+			filters = append(filters, func(id string) bool {
+				p, ok := positions[id]
+				return !ok || m.work(id) != work || p < first-info.Window || p > last+info.Window
+			})
+		}
+	}
+	if len(filters) == 0 {
+		return nil
+	}
+	return func(id string) bool {
+		for _, keep := range filters {
+			if !keep(id) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// positions numbers the passages of each work in citation order, for the
+// window option. It is computed on first use.
+func (m *model) positions() map[string]int {
+	m.positionsOnce.Do(func() {
+		works, members := m.workIDs()
+		m.sequence = make(map[string]int, m.store.Count())
+		for _, work := range works {
+			for i, id := range members[work] {
+				m.sequence[id] = i
+			}
+		}
+	})
+	return m.sequence
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// queryModel holds twelve passages of urn:cts:x:a.b and three of
+// urn:cts:x:c.d, whose first passage repeats the vector of a.b 1.9.
+func queryModel() *model {
+	thetas := randomThetas(15, 4, 3)
+	for i := range thetas {
+		if i < 12 {
+			thetas[i].ID = "urn:cts:x:a.b:1." + strconv.Itoa(i+1)
+		} else {
+			thetas[i].ID = "urn:cts:x:c.d:1." + strconv.Itoa(i-11)
+		}
+	}
+	thetas[12].Vector = thetas[8].Vector
+	return &model{store: newMemoryStore(thetas, make([]string, 4)), metric: jsdMetric{}, work: ctsWork}
+}
+
+func TestInfoFromRequest(t *testing.T) {
+	m := queryModel()
+	cases := []struct {
+		query   string
+		want    Info
+		wantErr bool
+	}{
+		{"", Info{Metric: jsdMetric{}}, false},
+		{"metric=hellinger&exact=true&work=only&order=citation&excludeSelf=true&excludePrefix=urn:a&excludePrefix=urn:b&window=2&minDistance=0.25",
+			Info{Metric: hellingerMetric{}, Exact: true, Scope: workScopeOnly, Order: "citation", ExcludeSelf: true,
+				ExcludePrefixes: []string{"urn:a", "urn:b"}, Window: 2, MinDistance: 0.25}, false},
+		{"work=exclude&order=rank&exact=yes&excludeSelf=1", Info{Metric: jsdMetric{}, Scope: workScopeExclude, Order: "rank"}, false},
+		{"minDistance=0&window=0", Info{Metric: jsdMetric{}}, false},
+		{"work=mine", Info{}, true},
+		{"order=random", Info{}, true},
+		{"window=-1", Info{}, true},
+		{"window=two", Info{}, true},
+		{"minDistance=near", Info{}, true},
+		{"metric=nope", Info{}, true},
+		{"filter=author", Info{}, true},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/view/urn:cts:x:a.b:1.9/5/json?"+c.query, nil)
+		r = mux.SetURLVars(r, map[string]string{"urn": "urn:cts:x:a.b:1.9", "count": "5"})
+		info, err := infoFromRequest(m, r)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%q: error %v, want error %v", c.query, err, c.wantErr)
+			continue
+		}
+		if c.wantErr {
+			continue
+		}
+		c.want.URN, c.want.Count = "urn:cts:x:a.b:1.9", 5
+		if info.Keep != nil {
+			t.Errorf("%q: a filter without filter options", c.query)
+		}
+		if !reflect.DeepEqual(info, c.want) {
+			t.Errorf("%q: %+v, want %+v", c.query, info, c.want)
+		}
+	}
+}
+
+func TestExclusions(t *testing.T) {
+	m := queryModel()
+	a := func(n int) string { return "urn:cts:x:a.b:1." + strconv.Itoa(n) }
+	c := func(n int) string { return "urn:cts:x:c.d:1." + strconv.Itoa(n) }
+	cases := []struct {
+		name     string
+		info     Info
+		members  []string
+		excluded []string
+	}{
+		{"work only", Info{URN: a(9), Scope: workScopeOnly}, []string{a(9)}, []string{c(1), c(2), c(3)}},
+		{"work excluded", Info{URN: c(2), Scope: workScopeExclude}, []string{c(2)}, []string{c(1), c(2), c(3)}},
+		// Prefixes are matched as text, so 1.1 also covers 1.10 to 1.12.
+		{"prefix", Info{URN: a(9), ExcludePrefixes: []string{a(1)}}, []string{a(9)}, []string{a(1), a(10), a(11), a(12)}},
+		{"empty prefix", Info{URN: a(9), ExcludePrefixes: []string{"", "urn:cts:x:c.d:"}}, []string{a(9)}, []string{c(1), c(2), c(3)}},
+		// Citation order runs 1.8, 1.9, 1.10, 1.11, whatever the string order.
+		{"window at 1.9", Info{URN: a(9), Window: 1}, []string{a(9)}, []string{a(8), a(9), a(10)}},
+		{"window at 1.10", Info{URN: a(10), Window: 1}, []string{a(10)}, []string{a(9), a(10), a(11)}},
+		{"window at the end of a work", Info{URN: a(12), Window: 2}, []string{a(12)}, []string{a(10), a(11), a(12)}},
+		{"window around a range", Info{URN: "urn:cts:x:a.b:1.9-1.10", Window: 1}, []string{a(9), a(10)}, []string{a(8), a(9), a(10), a(11)}},
+		{"range members", Info{URN: "urn:cts:x:a.b:1.9-1.10"}, []string{a(9), a(10)}, []string{a(9), a(10)}},
+		{"window and prefix", Info{URN: c(1), Window: 1, ExcludePrefixes: []string{a(1)}}, []string{c(1)},
+			[]string{a(1), a(10), a(11), a(12), c(1), c(2)}},
+		{"metadata and work", Info{URN: a(9), Scope: workScopeExclude, Keep: func(id string) bool { return id != c(3) }}, []string{a(9)},
+			[]string{a(1), a(2), a(3), a(4), a(5), a(6), a(7), a(8), a(9), a(10), a(11), a(12), c(3)}},
+	}
+	var all []string
+	m.store.Vectors(func(id string, vector []float64) error {
+		all = append(all, id)
+		return nil
+	})
+	for _, tc := range cases {
+		keep := m.exclusions(tc.info, tc.members)
+		if keep == nil {
+			t.Errorf("%s: nothing excluded", tc.name)
+			continue
+		}
+		var excluded []string
+		for _, id := range all {
+			if !keep(id) {
+				excluded = append(excluded, id)
+			}
+		}
+		sortByCitation(excluded)
+		if !reflect.DeepEqual(excluded, tc.excluded) {
+			t.Errorf("%s: excluded %v, want %v", tc.name, excluded, tc.excluded)
+		}
+	}
+	// Without options nothing is filtered, so that the index can answer.
+	if keep := m.exclusions(Info{URN: a(9), Window: 0}, []string{a(9)}); keep != nil {
+		t.Error("exclusions without options gave a filter")
+	}
+}
+
+// The query is never its own neighbor. A minDistance of 0 keeps other
+// passages at distance 0; any positive one drops them.
+func TestSearchNearMinDistance(t *testing.T) {
+	m := queryModel()
+	m.buildIndex()
+	query, err := m.store.Get("urn:cts:x:a.b:1.9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	members := []string{query.ID}
+	neighbors, distances := m.searchNear(query, members, Info{URN: query.ID, Count: 3, Metric: jsdMetric{}, MinDistance: 0})
+	if len(neighbors) != 3 || neighbors[0].ID != "urn:cts:x:c.d:1.1" || distances[0] != 0 {
+		t.Fatalf("minDistance 0: %v at %v", sortedIDs(neighbors), distances)
+	}
+	exact, _ := m.searchNear(query, members, Info{URN: query.ID, Count: 3, Metric: jsdMetric{}, Exact: true})
+	if !reflect.DeepEqual(sortedIDs(neighbors), sortedIDs(exact)) {
+		t.Errorf("minDistance 0 found %v, an exact scan %v", sortedIDs(neighbors), sortedIDs(exact))
+	}
+	far, distances := m.searchNear(query, members, Info{URN: query.ID, Count: 3, Metric: jsdMetric{}, MinDistance: 1e-9})
+	for i, th := range far {
+		if th.ID == query.ID || distances[i] < 1e-9 {
+			t.Errorf("minDistance 1e-9 kept %s at %v", th.ID, distances[i])
+		}
+	}
+	if len(far) != 3 {
+		t.Errorf("minDistance 1e-9 found %d neighbors, want 3", len(far))
+	}
+}
+
+// excludeSelf leaves the query out of the listing, and ranks the
+// neighbors from 1 either way.
+func TestPassageResponseExcludeSelf(t *testing.T) {
+	query := theta{ID: "q", Text: "query"}
+	neighbors := []theta{{ID: "n1"}, {ID: "n2"}}
+	distances := []float64{0.1, 0.2}
+	for _, excludeSelf := range []bool{false, true} {
+		response := passageResponse(query, neighbors, distances, Info{ExcludeSelf: excludeSelf})
+		var got []string
+		for _, item := range response.Items {
+			got = append(got, item.Id+"@"+strconv.Itoa(item.Rank))
+		}
+		want := []string{"q@0", "n1@1", "n2@2"}
+		if excludeSelf {
+			want = want[1:]
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("excludeSelf=%v: %v, want %v", excludeSelf, got, want)
+		}
+	}
+}
+
+// sortedIDs lists the IDs of thetas, sorted, to compare result sets.
+func sortedIDs(thetas []theta) []string {
+	var ids []string
+	for _, th := range thetas {
+		ids = append(ids, th.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
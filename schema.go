@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+
+	"github.com/boltdb/bolt"
+)
+
+// Layout of metallo.db since schema version 2:
+//
+//	schema   "version" -> decimal schema version
+//	vectors  passage ID -> width byte (4 or 8) + little-endian floats
+//	texts    passage ID -> passage text
+//	topics   "topics"   -> gob-encoded topic labels
+//	meta     passage ID -> JSON object of metadata fields (optional)
+//
+// Version 1 kept gob-encoded theta structs, text included, in a single
+// "theta" bucket; -migrateDB converts such a database.
+const schemaVersion = 2
+
+var (
+	schemaBucket  = []byte("schema")
+	vectorsBucket = []byte("vectors")
+	textsBucket   = []byte("texts")
+	metaBucket    = []byte("meta")
+	legacyBucket  = []byte("theta")
+)
+
+var errLegacySchema = errors.New("metallo.db uses the old gob format; run with -migrateDB to convert it")
+
+// encodeVector packs a vector as float32 or float64 values, depending on
+// width (4 or 8 bytes).
+func encodeVector(vector []float64, width int) []byte {
+	if width != 4 {
+		width = 8
+	}
+	buf := make([]byte, 1+width*len(vector))
+	buf[0] = byte(width)
+	for i, v := range vector {
+		at := 1 + i*width
+		if width == 4 {
+			binary.LittleEndian.PutUint32(buf[at:], math.Float32bits(float32(v)))
+		} else {
+			binary.LittleEndian.PutUint64(buf[at:], math.Float64bits(v))
+		}
+	}
+	return buf
+}
+
+func decodeVector(data []byte) ([]float64, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty vector")
+	}
+	width := int(data[0])
+	if (width != 4 && width != 8) || (len(data)-1)%width != 0 {
+		return nil, fmt.Errorf("malformed vector of %d bytes", len(data))
+	}
+	vector := make([]float64, (len(data)-1)/width)
+	for i := range vector {
+		at := 1 + i*width
+		if width == 4 {
+			vector[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(data[at:])))
+		} else {
+			vector[i] = math.Float64frombits(binary.LittleEndian.Uint64(data[at:]))
+		}
+	}
+	return vector, nil
+}
+
+// vectorWidth is the configured on-disk precision in bytes.
+func vectorWidth(conf serverConfig) int {
+	if conf.Float32Vectors {
+		return 4
+	}
+	return 8
+}
+
+// initSchema creates the buckets of the current schema and stamps the
+// version.
+func (s *boltStore) initSchema() error {
+	return s.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{vectorsBucket, textsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		bucket, err := tx.CreateBucketIfNotExists(schemaBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("version"), []byte(fmt.Sprint(schemaVersion)))
+	})
+}
+
+// checkSchema refuses databases written by an older or newer Metallo.
+func (s *boltStore) checkSchema() error {
+	return s.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(schemaBucket)
+		if bucket == nil {
+			if tx.Bucket(legacyBucket) != nil {
+				return errLegacySchema
+			}
+			return fmt.Errorf("metallo.db has no data; run with -loadDB first")
+		}
+		version := string(bucket.Get([]byte("version")))
+		if version != fmt.Sprint(schemaVersion) {
+			return fmt.Errorf("metallo.db has schema version %s, expected %d", version, schemaVersion)
+		}
+		return nil
+	})
+}
+
+// migrateDB rewrites a version 1 database into the current schema. The
+// result is written to a fresh file, which also compacts it, and replaces
+// the original once complete; the old file is kept as a .bak.
+func migrateDB(path string, conf serverConfig) error {
+	before, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	old, err := openBoltStore(path, dbTimeout(conf))
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+
+	tmppath := path + ".migrating"
+	os.Remove(tmppath)
+	db, err := openBoltStore(tmppath, dbTimeout(conf))
+	if err != nil {
+		return err
+	}
+	if err := db.initSchema(); err != nil {
+		db.Close()
+		return err
+	}
+	loader := newBulkLoader(db, conf.BatchSize, vectorWidth(conf))
+	status := newProgress(0)
+	var topics []string
+	migrated := 0
+	err = old.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(schemaBucket) != nil {
+			return errors.New("metallo.db is already in the current format")
+		}
+		bucket := tx.Bucket(legacyBucket)
+		if bucket == nil {
+			return fmt.Errorf("bucket %q not found", legacyBucket)
+		}
+		if tb := tx.Bucket([]byte("topics")); tb != nil {
+			topics, _ = gobDecodeTopics(tb.Get([]byte("topics")))
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			t, err := gobDecode(v)
+			if err != nil {
+				log.Printf("skipping %q: %v", k, err)
+				return nil
+			}
+			migrated++
+			committed, err := loader.Add(t, migrated)
+			if committed {
+				status.report(os.Stdout, migrated, 0)
+			}
+			return err
+		})
+	})
+	if err == nil {
+		err = loader.Flush()
+	}
+	if err == nil {
+		err = db.PutTopics(topics)
+	}
+	fmt.Println()
+	db.Close()
+	if err != nil {
+		os.Remove(tmppath)
+		return err
+	}
+	old.Close()
+	if err := os.Rename(path, path+".bak"); err != nil {
+		return err
+	}
+	if err := os.Rename(tmppath, path); err != nil {
+		return err
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	log.Printf("Migrated %d passages to schema version %d: %d -> %d bytes (old file kept as %s).",
+		loader.written, schemaVersion, before.Size(), after.Size(), path+".bak")
+	return nil
+}
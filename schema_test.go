@@ -0,0 +1,173 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestVectorRoundTrip(t *testing.T) {
+	vectors := [][]float64{
+		{},
+		{1},
+		{0.1, 0.2, 0.7},
+		{0.125, 0.25, 0.5, 0.0625, 0.0625},
+		{math.SmallestNonzeroFloat64, 1e-300, 0.3333333333333333},
+	}
+	for _, vector := range vectors {
+		data := encodeVector(vector, 8)
+		if data[0] != 8 || len(data) != 1+8*len(vector) {
+			t.Errorf("float64 encoding of %v: width %d, %d bytes", vector, data[0], len(data))
+		}
+		got, err := decodeVector(data)
+		if err != nil || len(got) != len(vector) {
+			t.Fatalf("decoding %v: %v, %v", vector, got, err)
+		}
+		for i := range vector {
+			if got[i] != vector[i] {
+				t.Errorf("float64 round trip of %v gave %v", vector, got)
+				break
+			}
+		}
+
+		data = encodeVector(vector, 4)
+		if data[0] != 4 || len(data) != 1+4*len(vector) {
+			t.Errorf("float32 encoding of %v: width %d, %d bytes", vector, data[0], len(data))
+		}
+		got, err = decodeVector(data)
+		if err != nil || len(got) != len(vector) {
+			t.Fatalf("decoding %v: %v, %v", vector, got, err)
+		}
+		for i := range vector {
+			if got[i] != float64(float32(vector[i])) {
+				t.Errorf("float32 round trip of %v gave %v", vector, got)
+				break
+			}
+		}
+	}
+	// Any width but 4 is stored as float64.
+	if data := encodeVector([]float64{1}, 2); data[0] != 8 {
+		t.Errorf("width 2 stored as %d", data[0])
+	}
+}
+
+func TestDecodeMalformedVector(t *testing.T) {
+	for _, data := range [][]byte{
+		nil,
+		{3, 0, 0, 0},          // unknown width
+		{8, 0, 0, 0, 0},       // not a whole float64
+		{4, 0, 0, 0, 0, 0, 0}, // not a whole float32
+		{8, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+	} {
+		if got, err := decodeVector(data); err == nil {
+			t.Errorf("decoded %v as %v", data, got)
+		}
+	}
+}
+
+// writeLegacyDB writes a schema version 1 database: gob-encoded thetas in
+// a single theta bucket and gob-encoded topics.
+func writeLegacyDB(t *testing.T, path string, thetas []theta, topics []string) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucket(legacyBucket)
+		if err != nil {
+			return err
+		}
+		for _, th := range thetas {
+			data, err := gobEncode(th)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(th.ID), data); err != nil {
+				return err
+			}
+		}
+		tb, err := tx.CreateBucket([]byte("topics"))
+		if err != nil {
+			return err
+		}
+		data, err := gobEncode(topics)
+		if err != nil {
+			return err
+		}
+		return tb.Put([]byte("topics"), data)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metallo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metallo.db")
+	thetas := []theta{
+		{ID: "urn:cts:x:a.b:1.1", Text: "first passage", Vector: []float64{0.2, 0.3, 0.5}},
+		{ID: "urn:cts:x:a.b:1.2", Text: "second passage", Vector: []float64{0.6, 0.3, 0.1}},
+	}
+	topics := []string{"alpha", "beta", "gamma"}
+	writeLegacyDB(t, path, thetas, topics)
+
+	db, err := openBoltStore(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.checkSchema(); err != errLegacySchema {
+		t.Errorf("checkSchema on a version 1 database: %v", err)
+	}
+	db.Close()
+
+	if err := migrateDB(path, serverConfig{BatchSize: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".bak"); err != nil {
+		t.Errorf("old database not kept: %v", err)
+	}
+	db, err = openBoltStore(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.checkSchema(); err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	if err := db.loadTopics(); err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(db.Topics(), topics) {
+		t.Errorf("topics %v, want %v", db.Topics(), topics)
+	}
+	if db.Count() != len(thetas) {
+		t.Errorf("%d passages, want %d", db.Count(), len(thetas))
+	}
+	for _, want := range thetas {
+		got, err := db.Get(want.ID)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if got.Text != want.Text || !reflect.DeepEqual(got.Vector, want.Vector) {
+			t.Errorf("%s migrated as %+v, want %+v", want.ID, got, want)
+		}
+	}
+	db.Close()
+
+	// A second migration refuses the converted database and leaves it be.
+	if err := migrateDB(path, serverConfig{}); err == nil {
+		t.Error("migrated a database twice")
+	}
+}
@@ -0,0 +1,684 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// thetaReader yields the passages of a topic model's output one at a time.
+// Next returns io.EOF once everything has been read.
+type thetaReader interface {
+	Topics() []string
+	Next() (theta, error)
+	// Line is the source line (or row) of the passage last returned.
+	Line() int
+	// Offset is how many bytes of the source have been consumed, or 0 if
+	// that is not known.
+	Offset() int64
+	Close() error
+}
+
+// Formats understood by openThetaReader; "auto" picks one from the file
+// name and first line.
+const (
+	formatCSV          = "csv"
+	formatMallet       = "mallet"
+	formatMalletSparse = "mallet-sparse"
+	formatGensim       = "gensim"
+	formatNumpy        = "npy"
+)
+
+// openThetaReader opens the configured theta source in the configured
+// format and, if a text_source or metaSource is given, joins passage texts
+// or metadata from it by ID.
+// The returned size is the source length in bytes.
+func openThetaReader(conf serverConfig) (thetaReader, int64, error) {
+	source, size, err := openResource(conf.Source, conf.Local)
+	if err != nil {
+		return nil, 0, err
+	}
+	buffered := bufio.NewReaderSize(source, 1<<16)
+	skipBOM(buffered)
+	format := strings.ToLower(conf.Format)
+	if format == "" || format == "auto" {
+		format = detectFormat(conf.Source, buffered)
+	}
+	log.Println("Reading", conf.Source, "as", format)
+
+	var reader thetaReader
+	switch format {
+	case formatCSV:
+		reader, err = newCSVReader(buffered, source, conf.MetaColumns)
+	case formatMallet, formatMalletSparse:
+		reader, err = newMalletReader(buffered, source, format == formatMalletSparse)
+	case formatGensim:
+		reader, err = newGensimReader(buffered, source)
+	case formatNumpy:
+		reader, err = newNumpyReader(buffered, source, conf)
+	default:
+		err = fmt.Errorf("unknown theta format %q", conf.Format)
+	}
+	if err != nil {
+		source.Close()
+		return nil, 0, err
+	}
+	if conf.TextSource != "" {
+		texts, err := readTexts(conf.TextSource, conf.Local)
+		if err != nil {
+			reader.Close()
+			return nil, 0, err
+		}
+		reader = &textJoin{thetaReader: reader, texts: texts}
+	}
+	if conf.MetaSource != "" {
+		meta, err := readMeta(conf.MetaSource, conf.Local)
+		if err != nil {
+			reader.Close()
+			return nil, 0, err
+		}
+		reader = &metaJoin{thetaReader: reader, meta: meta}
+	}
+	return reader, size, nil
+}
+
+// openResource opens a file, fetching it first if it is not local, and
+// reports its size in bytes.
+func openResource(file string, local bool) (io.ReadCloser, int64, error) {
+	if !local {
+		log.Println("Fetching external resource.")
+		data, err := getContent(file)
+		if err != nil {
+			return nil, 0, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+	}
+	log.Println("Fetching internal resource.")
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+// skipBOM drops the UTF-8 byte order mark some editors and spreadsheets
+// put at the start of text files.
+func skipBOM(r *bufio.Reader) {
+	if head, _ := r.Peek(3); bytes.Equal(head, []byte("\xef\xbb\xbf")) {
+		r.Discard(3)
+	}
+}
+
+func detectFormat(file string, r *bufio.Reader) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".npy":
+		return formatNumpy
+	case ".json":
+		return formatGensim
+	}
+	head, _ := r.Peek(4096)
+	switch {
+	case bytes.HasPrefix(head, []byte("\x93NUMPY")):
+		return formatNumpy
+	case bytes.HasPrefix(head, []byte("#doc")):
+		// The header alone does not tell: check whether the first data row
+		// continues with an integer topic index or a proportion.
+		lines := bytes.SplitN(head, []byte("\n"), 3)
+		if len(lines) > 1 {
+			fields := strings.Fields(string(lines[1]))
+			if len(fields) > 2 && !strings.Contains(fields[2], ".") {
+				return formatMalletSparse
+			}
+		}
+		return formatMallet
+	case bytes.HasPrefix(bytes.TrimSpace(head), []byte("[")), bytes.HasPrefix(bytes.TrimSpace(head), []byte("{")):
+		return formatGensim
+	}
+	firstLine := head
+	if i := bytes.IndexByte(head, '\n'); i >= 0 {
+		firstLine = head[:i]
+	}
+	if bytes.Count(firstLine, []byte("\t")) > 1 && bytes.IndexByte(firstLine, ',') < 0 {
+		return formatMallet
+	}
+	return formatCSV
+}
+
+// defaultTopics labels topics for formats that carry no header.
+func defaultTopics(count int) []string {
+	topics := make([]string, count)
+	for i := range topics {
+		topics[i] = "Topic" + strconv.Itoa(i+1)
+	}
+	return topics
+}
+
+// csvReader reads Metallo's own theta CSV: a header with the topic labels
+// from the fourth column on, then rows of index, passage ID, text and one
+// proportion per topic. Columns named in metaColumns hold passage metadata
+// instead of topics.
+type csvReader struct {
+	reader  *csv.Reader
+	closer  io.Closer
+	topics  []string
+	columns []int          // columns holding topics
+	meta    map[int]string // columns holding metadata, by name
+	line    int
+}
+
+func newCSVReader(r io.Reader, closer io.Closer, metaColumns []string) (*csvReader, error) {
+	reader := csv.NewReader(r)
+	reader.LazyQuotes = true
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %v", err)
+	}
+	c := &csvReader{reader: reader, closer: closer, line: 1}
+	isMeta := map[string]bool{}
+	for _, name := range metaColumns {
+		isMeta[name] = true
+	}
+	for j := range header {
+		if j < 3 {
+			continue
+		}
+		if isMeta[header[j]] {
+			if c.meta == nil {
+				c.meta = map[int]string{}
+			}
+			c.meta[j] = header[j]
+			continue
+		}
+		c.topics = append(c.topics, header[j])
+		c.columns = append(c.columns, j)
+	}
+	return c, nil
+}
+
+func (c *csvReader) Next() (theta, error) {
+	record, err := c.reader.Read()
+	if err != nil {
+		return theta{}, err
+	}
+	c.line++
+	if len(record) < 3 {
+		// Too short to hold any topics; validation reports it as ragged.
+		t := theta{}
+		if len(record) > 1 {
+			t.ID = record[1]
+		}
+		return t, nil
+	}
+	if c.meta == nil {
+		return parseThetaRecord(record), nil
+	}
+	t := theta{ID: record[1], Text: record[2], Meta: map[string]string{}}
+	var fields []string
+	for _, j := range c.columns {
+		if j < len(record) {
+			fields = append(fields, record[j])
+		}
+	}
+	t.Vector = parseProportions(fields)
+	for j, name := range c.meta {
+		if j < len(record) && record[j] != "" {
+			t.Meta[name] = record[j]
+		}
+	}
+	return t, nil
+}
+
+// parseThetaRecord reads a theta CSV row: an index, the passage ID, its
+// text and then one column per topic.
+func parseThetaRecord(record []string) theta {
+	return theta{ID: record[1], Text: record[2], Vector: parseProportions(record[3:])}
+}
+
+// parseProportions converts topic proportions, marking anything that is not
+// a number as NaN for validation to catch.
+func parseProportions(fields []string) []float64 {
+	vector := make([]float64, len(fields))
+	for j, field := range fields {
+		floatvalue, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			floatvalue = math.NaN()
+		}
+		vector[j] = floatvalue
+	}
+	return vector
+}
+
+func (c *csvReader) Topics() []string { return c.topics }
+func (c *csvReader) Line() int        { return c.line }
+func (c *csvReader) Offset() int64    { return c.reader.InputOffset() }
+func (c *csvReader) Close() error     { return c.closer.Close() }
+
+// malletReader reads MALLET --output-doc-topics files. Dense rows are
+// "index name p1 p2 ..."; sparse rows (MALLET before 2.0.8, announced by a
+// "#doc name topic proportion" header) list "topic proportion" pairs. Sparse
+// files are read completely up front since the topic count is only known
+// at the end.
+type malletReader struct {
+	scanner *bufio.Scanner
+	closer  io.Closer
+	topics  []string
+	line    int
+	offset  int64
+	pending []theta
+	lines   []int
+	sparse  bool
+}
+
+func newMalletReader(r io.Reader, closer io.Closer, sparse bool) (*malletReader, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 1<<16), 1<<28)
+	m := &malletReader{scanner: scanner, closer: closer, sparse: sparse}
+	if !sparse {
+		first, err := m.next()
+		if err != nil {
+			return nil, err
+		}
+		m.topics = defaultTopics(len(first.Vector))
+		m.pending = []theta{first}
+		m.lines = []int{m.line}
+		return m, nil
+	}
+	var rows []map[int]float64
+	var ids []string
+	topicCount := 0
+	for {
+		fields, err := m.fields()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		row := map[int]float64{}
+		for j := 2; j+1 < len(fields); j += 2 {
+			topic, err := strconv.Atoi(fields[j])
+			if err != nil || topic < 0 {
+				return nil, fmt.Errorf("line %d: bad topic index %q", m.line, fields[j])
+			}
+			row[topic] = parseProportions(fields[j+1 : j+2])[0]
+			if topic >= topicCount {
+				topicCount = topic + 1
+			}
+		}
+		rows = append(rows, row)
+		ids = append(ids, fields[1])
+		m.lines = append(m.lines, m.line)
+	}
+	for i, row := range rows {
+		vector := make([]float64, topicCount)
+		for topic, value := range row {
+			vector[topic] = value
+		}
+		m.pending = append(m.pending, theta{ID: ids[i], Vector: vector})
+	}
+	m.topics = defaultTopics(topicCount)
+	return m, nil
+}
+
+// fields returns the next non-comment line split on tabs (or spaces).
+func (m *malletReader) fields() ([]string, error) {
+	for m.scanner.Scan() {
+		m.line++
+		m.offset += int64(len(m.scanner.Bytes())) + 1
+		text := m.scanner.Text()
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		var fields []string
+		if strings.Contains(text, "\t") {
+			fields = strings.Split(strings.TrimRight(text, "\t"), "\t")
+		} else {
+			fields = strings.Fields(text)
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected an index and a name", m.line)
+		}
+		return fields, nil
+	}
+	if err := m.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+func (m *malletReader) next() (theta, error) {
+	fields, err := m.fields()
+	if err != nil {
+		return theta{}, err
+	}
+	return theta{ID: fields[1], Vector: parseProportions(fields[2:])}, nil
+}
+
+func (m *malletReader) Next() (theta, error) {
+	if len(m.pending) > 0 {
+		t := m.pending[0]
+		m.pending = m.pending[1:]
+		m.line, m.lines = m.lines[0], m.lines[1:]
+		return t, nil
+	}
+	if m.sparse {
+		return theta{}, io.EOF
+	}
+	return m.next()
+}
+
+func (m *malletReader) Topics() []string { return m.topics }
+func (m *malletReader) Line() int        { return m.line }
+func (m *malletReader) Offset() int64    { return m.offset }
+func (m *malletReader) Close() error     { return m.closer.Close() }
+
+// gensimReader reads document-topic distributions exported from gensim as
+// JSON, in either of these shapes:
+//
+//	[{"id": "urn:...", "topics": [[0, 0.12], [5, 0.8]], "text": "..."}, ...]
+//	{"urn:...": [[0, 0.12], [5, 0.8]], ...}
+//
+// where each topic list may also be a dense array of proportions. An
+// optional top-level {"topics": [...labels], "documents": ...} wrapper
+// supplies topic labels.
+type gensimReader struct {
+	closer io.Closer
+	topics []string
+	thetas []theta
+	line   int
+}
+
+type gensimDocument struct {
+	ID     string          `json:"id"`
+	Text   string          `json:"text"`
+	Topics json.RawMessage `json:"topics"`
+}
+
+func newGensimReader(r io.Reader, closer io.Closer) (*gensimReader, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var wrapper struct {
+		Topics    []string        `json:"topics"`
+		Documents json.RawMessage `json:"documents"`
+	}
+	if json.Unmarshal(data, &wrapper) == nil && len(wrapper.Documents) > 0 {
+		data = wrapper.Documents
+	}
+
+	var docs []gensimDocument
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		if err := json.Unmarshal(data, &docs); err != nil {
+			return nil, fmt.Errorf("reading gensim documents: %v", err)
+		}
+	} else {
+		var byID map[string]json.RawMessage
+		if err := json.Unmarshal(data, &byID); err != nil {
+			return nil, fmt.Errorf("reading gensim documents: %v", err)
+		}
+		var ids []string
+		for id := range byID {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			docs = append(docs, gensimDocument{ID: id, Topics: byID[id]})
+		}
+	}
+
+	g := &gensimReader{closer: closer}
+	sparse := make([]map[int]float64, len(docs))
+	topicCount := len(wrapper.Topics)
+	for i, doc := range docs {
+		row, err := gensimTopics(doc.Topics)
+		if err != nil {
+			return nil, fmt.Errorf("document %q: %v", doc.ID, err)
+		}
+		for topic := range row {
+			if topic >= topicCount {
+				topicCount = topic + 1
+			}
+		}
+		sparse[i] = row
+	}
+	for i, doc := range docs {
+		vector := make([]float64, topicCount)
+		for topic, value := range sparse[i] {
+			vector[topic] = value
+		}
+		g.thetas = append(g.thetas, theta{ID: doc.ID, Text: doc.Text, Vector: vector})
+	}
+	g.topics = wrapper.Topics
+	if len(g.topics) != topicCount {
+		g.topics = defaultTopics(topicCount)
+	}
+	return g, nil
+}
+
+// gensimTopics accepts either [[topic, weight], ...] pairs or a dense list.
+func gensimTopics(raw json.RawMessage) (map[int]float64, error) {
+	row := map[int]float64{}
+	var pairs [][2]float64
+	if err := json.Unmarshal(raw, &pairs); err == nil {
+		for _, pair := range pairs {
+			if pair[0] < 0 || pair[0] != math.Trunc(pair[0]) {
+				return nil, fmt.Errorf("bad topic index %v", pair[0])
+			}
+			row[int(pair[0])] = pair[1]
+		}
+		return row, nil
+	}
+	var dense []float64
+	if err := json.Unmarshal(raw, &dense); err != nil {
+		return nil, errors.New("topics must be [[topic, weight], ...] or a list of proportions")
+	}
+	for topic, value := range dense {
+		row[topic] = value
+	}
+	return row, nil
+}
+
+func (g *gensimReader) Next() (theta, error) {
+	if g.line >= len(g.thetas) {
+		return theta{}, io.EOF
+	}
+	g.line++
+	return g.thetas[g.line-1], nil
+}
+
+func (g *gensimReader) Topics() []string { return g.topics }
+func (g *gensimReader) Line() int        { return g.line }
+func (g *gensimReader) Offset() int64    { return 0 }
+func (g *gensimReader) Close() error     { return g.closer.Close() }
+
+// numpyReader streams a two-dimensional float32 or float64 .npy matrix of
+// documents by topics. Passage IDs come one per line from id_source, in
+// row order; without one, rows are numbered from 1.
+type numpyReader struct {
+	reader  io.Reader
+	closer  io.Closer
+	order   binary.ByteOrder
+	width   int
+	rows    int
+	cols    int
+	row     int
+	ids     []string
+	topics  []string
+	offset  int64
+	scratch []byte
+}
+
+var npyShape = regexp.MustCompile(`'shape':\s*\((\d+),\s*(\d+),?\s*\)`)
+var npyDescr = regexp.MustCompile(`'descr':\s*'([<>|=])f([48])'`)
+
+func newNumpyReader(r io.Reader, closer io.Closer, conf serverConfig) (*numpyReader, error) {
+	magic := make([]byte, 8)
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.HasPrefix(magic, []byte("\x93NUMPY")) {
+		return nil, errors.New("not a .npy file")
+	}
+	var headerLen int
+	var prefix int64 = 8
+	if magic[6] == 1 {
+		var n uint16
+		if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+			return nil, err
+		}
+		headerLen, prefix = int(n), prefix+2
+	} else {
+		var n uint32
+		if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+			return nil, err
+		}
+		headerLen, prefix = int(n), prefix+4
+	}
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if bytes.Contains(header, []byte("'fortran_order': True")) {
+		return nil, errors.New(".npy matrix must be in C order")
+	}
+	descr := npyDescr.FindSubmatch(header)
+	shape := npyShape.FindSubmatch(header)
+	if descr == nil || shape == nil {
+		return nil, fmt.Errorf("unsupported .npy header %s (need a 2-d float32 or float64 matrix)", header)
+	}
+	n := &numpyReader{reader: r, closer: closer, order: binary.LittleEndian, offset: prefix + int64(headerLen)}
+	if descr[1][0] == '>' {
+		n.order = binary.BigEndian
+	}
+	n.width, _ = strconv.Atoi(string(descr[2]))
+	n.rows, _ = strconv.Atoi(string(shape[1]))
+	n.cols, _ = strconv.Atoi(string(shape[2]))
+	n.scratch = make([]byte, n.width*n.cols)
+	n.topics = defaultTopics(n.cols)
+	if conf.IDSource != "" {
+		ids, err := readLines(conf.IDSource, conf.Local)
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) != n.rows {
+			return nil, fmt.Errorf("%s lists %d IDs for %d matrix rows", conf.IDSource, len(ids), n.rows)
+		}
+		n.ids = ids
+	}
+	return n, nil
+}
+
+func (n *numpyReader) Next() (theta, error) {
+	if n.row >= n.rows {
+		return theta{}, io.EOF
+	}
+	if _, err := io.ReadFull(n.reader, n.scratch); err != nil {
+		return theta{}, fmt.Errorf("row %d: %v", n.row+1, err)
+	}
+	n.offset += int64(len(n.scratch))
+	vector := make([]float64, n.cols)
+	for j := range vector {
+		at := j * n.width
+		if n.width == 4 {
+			vector[j] = float64(math.Float32frombits(n.order.Uint32(n.scratch[at:])))
+		} else {
+			vector[j] = math.Float64frombits(n.order.Uint64(n.scratch[at:]))
+		}
+	}
+	id := strconv.Itoa(n.row + 1)
+	if n.ids != nil {
+		id = n.ids[n.row]
+	}
+	n.row++
+	return theta{ID: id, Vector: vector}, nil
+}
+
+func (n *numpyReader) Topics() []string { return n.topics }
+func (n *numpyReader) Line() int        { return n.row }
+func (n *numpyReader) Offset() int64    { return n.offset }
+func (n *numpyReader) Close() error     { return n.closer.Close() }
+
+// textJoin fills in passage texts from a separate file.
+type textJoin struct {
+	thetaReader
+	texts map[string]string
+}
+
+func (j *textJoin) Next() (theta, error) {
+	t, err := j.thetaReader.Next()
+	if err == nil {
+		if text, ok := j.texts[t.ID]; ok {
+			t.Text = text
+		}
+	}
+	return t, err
+}
+
+// readTexts reads "ID,text" rows (tab-separated for .tsv and .txt files).
+func readTexts(file string, local bool) (map[string]string, error) {
+	source, _, err := openResource(file, local)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+	buffered := bufio.NewReader(source)
+	skipBOM(buffered)
+	reader := csv.NewReader(buffered)
+	reader.LazyQuotes = true
+	reader.FieldsPerRecord = -1
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".tsv", ".txt":
+		reader.Comma = '\t'
+	}
+	texts := map[string]string{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %v", file, err)
+		}
+		if len(record) >= 2 {
+			texts[record[0]] = record[1]
+		}
+	}
+	return texts, nil
+}
+
+func readLines(file string, local bool) ([]string, error) {
+	source, _, err := openResource(file, local)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+	var lines []string
+	buffered := bufio.NewReader(source)
+	skipBOM(buffered)
+	scanner := bufio.NewScanner(buffered)
+	scanner.Buffer(make([]byte, 1<<16), 1<<24)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const bom = "\xef\xbb\xbf"
+
+// npyFile builds a .npy file holding values as a rows×cols matrix of the
+// given dtype ('<f8', '>f4', ...).
+func npyFile(descr string, rows, cols int, fortran bool, values []float64) []byte {
+	order := "False"
+	if fortran {
+		order = "True"
+	}
+	header := fmt.Sprintf("{'descr': '%s', 'fortran_order': %s, 'shape': (%d, %d), }", descr, order, rows, cols)
+	header += strings.Repeat(" ", 63-(10+len(header))%64) + "\n"
+	var buf bytes.Buffer
+	buf.WriteString("\x93NUMPY\x01\x00")
+	binary.Write(&buf, binary.LittleEndian, uint16(len(header)))
+	buf.WriteString(header)
+	var byteOrder binary.ByteOrder = binary.LittleEndian
+	if descr[0] == '>' {
+		byteOrder = binary.BigEndian
+	}
+	for _, v := range values {
+		if descr[2] == '4' {
+			binary.Write(&buf, byteOrder, float32(v))
+		} else {
+			binary.Write(&buf, byteOrder, v)
+		}
+	}
+	return buf.Bytes()
+}
+
+// readSource writes files into a temporary directory, opens conf.Source
+// among them and reads all of it.
+func readSource(t *testing.T, conf serverConfig, files map[string]string) ([]string, []theta, error) {
+	dir, err := ioutil.TempDir("", "metallo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conf.Local = true
+	conf.Source = filepath.Join(dir, conf.Source)
+	if conf.TextSource != "" {
+		conf.TextSource = filepath.Join(dir, conf.TextSource)
+	}
+	if conf.IDSource != "" {
+		conf.IDSource = filepath.Join(dir, conf.IDSource)
+	}
+	reader, _, err := openThetaReader(conf)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer reader.Close()
+	var thetas []theta
+	for {
+		th, err := reader.Next()
+		if err == io.EOF {
+			return reader.Topics(), thetas, nil
+		}
+		if err != nil {
+			return reader.Topics(), thetas, err
+		}
+		thetas = append(thetas, th)
+	}
+}
+
+func TestThetaSources(t *testing.T) {
+	cases := []struct {
+		name    string
+		conf    serverConfig
+		files   map[string]string
+		topics  []string
+		ids     []string
+		texts   []string
+		vectors [][]float64
+		wantErr bool
+	}{
+		{
+			name: "csv",
+			conf: serverConfig{Source: "theta.csv"},
+			files: map[string]string{"theta.csv": "index,id,text,alpha,beta\n" +
+				"0,urn:a:1,one,0.25,0.75\n1,urn:a:2,\"two, quoted\",0.5,0.5\n"},
+			topics:  []string{"alpha", "beta"},
+			ids:     []string{"urn:a:1", "urn:a:2"},
+			texts:   []string{"one", "two, quoted"},
+			vectors: [][]float64{{0.25, 0.75}, {0.5, 0.5}},
+		},
+		{
+			name: "csv with a BOM, CRLF and blank lines",
+			conf: serverConfig{Source: "theta.csv"},
+			files: map[string]string{"theta.csv": bom + "index,id,text,alpha,beta\r\n\r\n" +
+				"0,urn:a:1,one,0.25,0.75\r\n\r\n1,urn:a:2,two,0.5,0.5\r\n"},
+			topics:  []string{"alpha", "beta"},
+			ids:     []string{"urn:a:1", "urn:a:2"},
+			texts:   []string{"one", "two"},
+			vectors: [][]float64{{0.25, 0.75}, {0.5, 0.5}},
+		},
+		{
+			name: "csv with meta columns",
+			conf: serverConfig{Source: "theta.csv", MetaColumns: []string{"author"}},
+			files: map[string]string{"theta.csv": "index,id,text,author,alpha,beta\n" +
+				"0,urn:a:1,one,Dignaga,0.25,0.75\n"},
+			topics:  []string{"alpha", "beta"},
+			ids:     []string{"urn:a:1"},
+			texts:   []string{"one"},
+			vectors: [][]float64{{0.25, 0.75}},
+		},
+		{
+			name:    "empty csv",
+			conf:    serverConfig{Source: "theta.csv"},
+			files:   map[string]string{"theta.csv": ""},
+			wantErr: true,
+		},
+		{
+			name: "mallet dense",
+			conf: serverConfig{Source: "doc-topics.txt"},
+			files: map[string]string{"doc-topics.txt": "#doc name topic proportion ...\n" +
+				"0\turn:a:1\t0.1\t0.2\t0.7\n\n1\turn:a:2\t0.3\t0.3\t0.4\t\n"},
+			topics:  []string{"Topic1", "Topic2", "Topic3"},
+			ids:     []string{"urn:a:1", "urn:a:2"},
+			vectors: [][]float64{{0.1, 0.2, 0.7}, {0.3, 0.3, 0.4}},
+		},
+		{
+			name: "mallet dense with a BOM",
+			conf: serverConfig{Source: "doc-topics.txt"},
+			files: map[string]string{"doc-topics.txt": bom + "#doc name topic proportion ...\n" +
+				"0\turn:a:1\t0.1\t0.9\n"},
+			topics:  []string{"Topic1", "Topic2"},
+			ids:     []string{"urn:a:1"},
+			vectors: [][]float64{{0.1, 0.9}},
+		},
+		{
+			name:    "mallet dense without a name",
+			conf:    serverConfig{Source: "doc-topics.txt", Format: formatMallet},
+			files:   map[string]string{"doc-topics.txt": "0\turn:a:1\t0.5\t0.5\n7\n"},
+			ids:     []string{"urn:a:1"},
+			vectors: [][]float64{{0.5, 0.5}},
+			wantErr: true,
+		},
+		{
+			name: "mallet sparse",
+			conf: serverConfig{Source: "doc-topics.txt"},
+			files: map[string]string{"doc-topics.txt": "#doc name topic proportion ...\n" +
+				"0 urn:a:1 2 0.6 0 0.4\n1 urn:a:2 1 1.0\n"},
+			topics:  []string{"Topic1", "Topic2", "Topic3"},
+			ids:     []string{"urn:a:1", "urn:a:2"},
+			vectors: [][]float64{{0.4, 0, 0.6}, {0, 1, 0}},
+		},
+		{
+			name:    "mallet sparse with a bad topic",
+			conf:    serverConfig{Source: "doc-topics.txt", Format: formatMalletSparse},
+			files:   map[string]string{"doc-topics.txt": "0 urn:a:1 2 0.6 -1 0.4\n"},
+			wantErr: true,
+		},
+		{
+			name: "gensim list",
+			conf: serverConfig{Source: "theta.json"},
+			files: map[string]string{"theta.json": `[{"id": "urn:a:1", "text": "one", "topics": [[1, 0.8], [0, 0.2]]},
+				{"id": "urn:a:2", "topics": [0.5, 0.25, 0.25]}]`},
+			topics:  []string{"Topic1", "Topic2", "Topic3"},
+			ids:     []string{"urn:a:1", "urn:a:2"},
+			texts:   []string{"one", ""},
+			vectors: [][]float64{{0.2, 0.8, 0}, {0.5, 0.25, 0.25}},
+		},
+		{
+			name: "gensim object with labels",
+			conf: serverConfig{Source: "theta.json"},
+			files: map[string]string{"theta.json": bom + `{"topics": ["sky", "sea"],
+				"documents": {"urn:a:2": [[1, 1]], "urn:a:1": [0.9, 0.1]}}`},
+			topics:  []string{"sky", "sea"},
+			ids:     []string{"urn:a:1", "urn:a:2"},
+			vectors: [][]float64{{0.9, 0.1}, {0, 1}},
+		},
+		{
+			name:    "gensim with a fractional topic",
+			conf:    serverConfig{Source: "theta.json"},
+			files:   map[string]string{"theta.json": `[{"id": "urn:a:1", "topics": [[0.5, 1]]}]`},
+			wantErr: true,
+		},
+		{
+			name:    "gensim with topics that are not a list",
+			conf:    serverConfig{Source: "theta.json"},
+			files:   map[string]string{"theta.json": `{"urn:a:1": "sky"}`},
+			wantErr: true,
+		},
+		{
+			name:    "npy float64",
+			conf:    serverConfig{Source: "theta.npy"},
+			files:   map[string]string{"theta.npy": string(npyFile("<f8", 2, 3, false, []float64{0.1, 0.2, 0.7, 0.3, 0.3, 0.4}))},
+			topics:  []string{"Topic1", "Topic2", "Topic3"},
+			ids:     []string{"1", "2"},
+			vectors: [][]float64{{0.1, 0.2, 0.7}, {0.3, 0.3, 0.4}},
+		},
+		{
+			name: "npy big-endian float32 with IDs",
+			conf: serverConfig{Source: "theta.bin", Format: formatNumpy, IDSource: "ids.txt"},
+			files: map[string]string{
+				"theta.bin": string(npyFile(">f4", 2, 2, false, []float64{0.25, 0.75, 0.5, 0.5})),
+				"ids.txt":   bom + "urn:a:1\n\nurn:a:2\n",
+			},
+			topics:  []string{"Topic1", "Topic2"},
+			ids:     []string{"urn:a:1", "urn:a:2"},
+			vectors: [][]float64{{0.25, 0.75}, {0.5, 0.5}},
+		},
+		{
+			name: "npy with too few IDs",
+			conf: serverConfig{Source: "theta.npy", IDSource: "ids.txt"},
+			files: map[string]string{
+				"theta.npy": string(npyFile("<f8", 2, 2, false, []float64{0.25, 0.75, 0.5, 0.5})),
+				"ids.txt":   "urn:a:1\n",
+			},
+			wantErr: true,
+		},
+		{
+			name:    "npy of integers",
+			conf:    serverConfig{Source: "theta.npy"},
+			files:   map[string]string{"theta.npy": string(npyFile("<i8", 1, 2, false, []float64{1, 2}))},
+			wantErr: true,
+		},
+		{
+			name:    "npy in Fortran order",
+			conf:    serverConfig{Source: "theta.npy"},
+			files:   map[string]string{"theta.npy": string(npyFile("<f8", 1, 2, true, []float64{0.5, 0.5}))},
+			wantErr: true,
+		},
+		{
+			name:    "npy cut short",
+			conf:    serverConfig{Source: "theta.npy"},
+			files:   map[string]string{"theta.npy": string(npyFile("<f8", 2, 2, false, []float64{0.5, 0.5, 0.5}))},
+			topics:  []string{"Topic1", "Topic2"},
+			ids:     []string{"1"},
+			vectors: [][]float64{{0.5, 0.5}},
+			wantErr: true,
+		},
+		{
+			name:    "not npy",
+			conf:    serverConfig{Source: "theta.npy"},
+			files:   map[string]string{"theta.npy": "index,id,text,alpha\n"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown format",
+			conf:    serverConfig{Source: "theta.csv", Format: "parquet"},
+			files:   map[string]string{"theta.csv": "index,id,text,alpha\n"},
+			wantErr: true,
+		},
+	}
+	for _, c := range cases {
+		topics, thetas, err := readSource(t, c.conf, c.files)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: error %v, want error %v", c.name, err, c.wantErr)
+			continue
+		}
+		if c.topics != nil && !reflect.DeepEqual(topics, c.topics) {
+			t.Errorf("%s: topics %q, want %q", c.name, topics, c.topics)
+		}
+		var ids []string
+		var texts []string
+		var vectors [][]float64
+		for _, th := range thetas {
+			ids = append(ids, th.ID)
+			texts = append(texts, th.Text)
+			vectors = append(vectors, th.Vector)
+		}
+		if !reflect.DeepEqual(ids, c.ids) {
+			t.Errorf("%s: IDs %q, want %q", c.name, ids, c.ids)
+		}
+		if c.texts != nil && !reflect.DeepEqual(texts, c.texts) {
+			t.Errorf("%s: texts %q, want %q", c.name, texts, c.texts)
+		}
+		if !reflect.DeepEqual(vectors, c.vectors) {
+			t.Errorf("%s: vectors %v, want %v", c.name, vectors, c.vectors)
+		}
+	}
+}
+
+// Proportions that are not numbers reach validation as NaN rather than
+// failing the read.
+func TestParseProportions(t *testing.T) {
+	got := parseProportions([]string{" 0.5", "n/a", "1e-3"})
+	if got[0] != 0.5 || !math.IsNaN(got[1]) || got[2] != 0.001 {
+		t.Errorf("parseProportions gave %v", got)
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	cases := []struct {
+		file, head, want string
+	}{
+		{"theta.npy", "", formatNumpy},
+		{"theta.JSON", "", formatGensim},
+		{"theta", "\x93NUMPY\x01\x00", formatNumpy},
+		{"doc-topics.txt", "#doc name topic proportion ...\n0\turn:a:1\t0.1\t0.9\n", formatMallet},
+		{"doc-topics.txt", "#doc name topic proportion ...\n0 urn:a:1 1 0.9 0 0.1\n", formatMalletSparse},
+		{"doc-topics.txt", "#doc name topic proportion ...\n", formatMallet},
+		{"doc-topics.txt", "0\turn:a:1\t0.1\t0.9\n", formatMallet},
+		{"theta.txt", "  [{\"id\": \"urn:a:1\"}]", formatGensim},
+		{"theta.txt", "{\"urn:a:1\": [0.5, 0.5]}", formatGensim},
+		{"theta.csv", "index,id,text,alpha\n0,urn:a:1,a\tb\tc,1\n", formatCSV},
+		{"theta.csv", "index,id,text,alpha\n", formatCSV},
+		{"theta.csv", "", formatCSV},
+	}
+	for _, c := range cases {
+		if got := detectFormat(c.file, bufio.NewReader(strings.NewReader(c.head))); got != c.want {
+			t.Errorf("detectFormat(%q, %q) = %s, want %s", c.file, c.head, got, c.want)
+		}
+	}
+}
+
+// Texts from text_source replace those of the theta source by ID; passages
+// without one keep their own.
+func TestTextJoin(t *testing.T) {
+	cases := []struct {
+		name     string
+		textFile string
+		texts    string
+		want     []string
+		wantErr  bool
+	}{
+		{"csv", "texts.csv", "urn:a:2,second\nurn:a:1,\"first, quoted\"\nurn:a:9,unused\n", []string{"first, quoted", "second", "own"}, false},
+		{"tsv with a BOM", "texts.tsv", bom + "urn:a:1\tfirst\n\nurn:a:3\tthird\tignored\n", []string{"first", "", "third"}, false},
+		{"short rows", "texts.txt", "urn:a:1\nurn:a:2\tsecond\n", []string{"", "second", "own"}, false},
+		{"missing file", "texts.csv", "", nil, true},
+	}
+	source := "index,id,text,alpha,beta\n0,urn:a:1,,0.5,0.5\n1,urn:a:2,,0.5,0.5\n2,urn:a:3,own,0.5,0.5\n"
+	for _, c := range cases {
+		files := map[string]string{"theta.csv": source}
+		if c.texts != "" {
+			files[c.textFile] = c.texts
+		}
+		_, thetas, err := readSource(t, serverConfig{Source: "theta.csv", TextSource: c.textFile}, files)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: error %v, want error %v", c.name, err, c.wantErr)
+			continue
+		}
+		var texts []string
+		for _, th := range thetas {
+			texts = append(texts, th.Text)
+		}
+		if !reflect.DeepEqual(texts, c.want) {
+			t.Errorf("%s: texts %q, want %q", c.name, texts, c.want)
+		}
+	}
+}
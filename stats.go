@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultStatsThreshold is the proportion from which a topic counts as
+// present in a passage, unless ?threshold= says otherwise.
+const defaultStatsThreshold = 0.1
+
+// maxCachedStats bounds the statistics kept per model; the cache starts
+// over once it is full.
+const maxCachedStats = 64
+
+type topicStat struct {
+	Topic        int     `json:"topic"` // numbered from 1
+	Label        string  `json:"label"`
+	Mean         float64 `json:"mean"`         // mean proportion
+	DocFrequency int     `json:"docFrequency"` // passages at or above the threshold
+	DocShare     float64 `json:"docShare"`     // the same as a share of all passages
+	Entropy      float64 `json:"entropy"`      // in bits, of the topic's spread over passages
+}
+
+// topicStats describes the topics of the whole corpus or of one work.
+// Cooccurrence counts the passages in which both topics reach the
+// threshold; Correlation is the Pearson correlation of their proportions.
+type topicStats struct {
+	Work               string      `json:"work,omitempty"`
+	Passages           int         `json:"passages"`
+	Threshold          float64     `json:"threshold"`
+	MeanPassageEntropy float64     `json:"meanPassageEntropy"` // in bits
+	Topics             []topicStat `json:"topics"`
+	Cooccurrence       [][]int     `json:"cooccurrence"`
+	Correlation        [][]float64 `json:"correlation"`
+}
+
+// topicStats computes the statistics of the passages of work, or of all
+// passages if work is empty, in a single scan. Results are cached.
+func (m *model) topicStats(work string, threshold float64) (*topicStats, error) {
+	key := work + "\x00" + strconv.FormatFloat(threshold, 'g', -1, 64)
+	m.statsMu.Lock()
+	cached, ok := m.stats[key]
+	m.statsMu.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	topics := m.store.Topics()
+	k := len(topics)
+	n := 0
+	sum := make([]float64, k)
+	sumLog := make([]float64, k) // of p log2 p
+	cross := make([][]float64, k)
+	together := make([][]int, k)
+	for i := range cross {
+		cross[i] = make([]float64, k)
+		together[i] = make([]int, k)
+	}
+	var passageEntropy float64
+	present := make([]int, 0, k)
+	m.store.Vectors(func(id string, vector []float64) error {
+		if work != "" && m.work(id) != work {
+			return nil
+		}
+		n++
+		present = present[:0]
+		for i := 0; i < k && i < len(vector); i++ {
+			p := vector[i]
+			sum[i] += p
+			if p > 0 {
+				sumLog[i] += p * math.Log2(p)
+				passageEntropy -= p * math.Log2(p)
+			}
+			if p >= threshold {
+				present = append(present, i)
+			}
+			for j := 0; j <= i; j++ {
+				cross[i][j] += p * vector[j]
+			}
+		}
+		for _, i := range present {
+			for _, j := range present {
+				together[i][j]++
+			}
+		}
+		return nil
+	})
+	if n == 0 {
+		return nil, fmt.Errorf("no passages in work %q", work)
+	}
+
+	stats := &topicStats{
+		Work:               work,
+		Passages:           n,
+		Threshold:          threshold,
+		MeanPassageEntropy: round6(passageEntropy / float64(n)),
+		Cooccurrence:       together,
+		Correlation:        make([][]float64, k),
+	}
+	mean := make([]float64, k)
+	sd := make([]float64, k)
+	for i := range topics {
+		mean[i] = sum[i] / float64(n)
+		sd[i] = math.Sqrt(math.Max(cross[i][i]/float64(n)-mean[i]*mean[i], 0))
+		stat := topicStat{
+			Topic:        i + 1,
+			Label:        topics[i],
+			Mean:         round6(mean[i]),
+			DocFrequency: together[i][i],
+			DocShare:     round6(float64(together[i][i]) / float64(n)),
+		}
+		// With q = p / sum over passages, -sum q log q = log sum - sum p log p / sum.
+		if sum[i] > 0 {
+			stat.Entropy = round6(math.Log2(sum[i]) - sumLog[i]/sum[i])
+		}
+		stats.Topics = append(stats.Topics, stat)
+	}
+	for i := range topics {
+		stats.Correlation[i] = make([]float64, k)
+		for j := range topics {
+			a, b := i, j
+			if b > a {
+				a, b = b, a
+			}
+			covariance := cross[a][b]/float64(n) - mean[i]*mean[j]
+			if sd[i] > 0 && sd[j] > 0 {
+				stats.Correlation[i][j] = round6(covariance / (sd[i] * sd[j]))
+			}
+		}
+	}
+
+	m.statsMu.Lock()
+	if m.stats == nil || len(m.stats) >= maxCachedStats {
+		m.stats = map[string]*topicStats{}
+	}
+	m.stats[key] = stats
+	m.statsMu.Unlock()
+	return stats, nil
+}
+
+func round6(v float64) float64 {
+	return math.Round(v*1e6) / 1e6
+}
+
+// ViewStats answers /stats and /stats/{work} with the topic statistics of
+// the corpus or of one work. ?threshold= sets the proportion from which a
+// topic counts as present (default 0.1).
+func ViewStats(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	m, release := modelFromRequest(w, r)
+	defer release()
+	if m == nil {
+		return
+	}
+	threshold := defaultStatsThreshold
+	if v := r.URL.Query().Get("threshold"); v != "" {
+		var err error
+		threshold, err = strconv.ParseFloat(v, 64)
+		if err != nil || threshold < 0 || threshold > 1 {
+			http.Error(w, "threshold must be a proportion between 0 and 1", http.StatusBadRequest)
+			return
+		}
+	}
+	stats, err := m.topicStats(mux.Vars(r)["work"], threshold)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	// Labels can change after the statistics were cached.
+	result := *stats
+	result.Topics = append([]topicStat(nil), stats.Topics...)
+	for i := range result.Topics {
+		result.Topics[i].Label = m.topicLabel(i)
+	}
+	resultJSON, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintln(w, string(resultJSON))
+}
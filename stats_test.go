@@ -0,0 +1,115 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// statsModel has three passages over three topics, two of them in
+// urn:cts:x:a.b and one in urn:cts:x:c.d.
+func statsModel() *model {
+	thetas := []theta{
+		{ID: "urn:cts:x:a.b:1.1", Vector: []float64{1, 0, 0}},
+		{ID: "urn:cts:x:a.b:1.2", Vector: []float64{0.5, 0.5, 0}},
+		{ID: "urn:cts:x:c.d:1.1", Vector: []float64{0.25, 0.25, 0.5}},
+	}
+	return &model{store: newMemoryStore(thetas, []string{"T1", "T2", "T3"}), work: ctsWork}
+}
+
+// entropy is the entropy in bits of weights once they are normalized.
+func entropy(weights ...float64) float64 {
+	var sum, h float64
+	for _, w := range weights {
+		sum += w
+	}
+	for _, w := range weights {
+		if w > 0 {
+			h -= w / sum * math.Log2(w/sum)
+		}
+	}
+	return h
+}
+
+// pearson is the correlation of x and y, computed the textbook way.
+func pearson(x, y []float64) float64 {
+	var mx, my float64
+	for i := range x {
+		mx += x[i] / float64(len(x))
+		my += y[i] / float64(len(y))
+	}
+	var cov, vx, vy float64
+	for i := range x {
+		cov += (x[i] - mx) * (y[i] - my)
+		vx += (x[i] - mx) * (x[i] - mx)
+		vy += (y[i] - my) * (y[i] - my)
+	}
+	return cov / math.Sqrt(vx*vy)
+}
+
+func TestTopicStats(t *testing.T) {
+	m := statsModel()
+	stats, err := m.topicStats("", 0.25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Passages != 3 || stats.Work != "" || stats.Threshold != 0.25 {
+		t.Errorf("stats of %d passages of %q at %v", stats.Passages, stats.Work, stats.Threshold)
+	}
+	if want := round6((0 + 1 + 1.5) / 3); stats.MeanPassageEntropy != want {
+		t.Errorf("mean passage entropy %v, want %v", stats.MeanPassageEntropy, want)
+	}
+	// A proportion equal to the threshold counts as present.
+	want := []topicStat{
+		{Topic: 1, Label: "T1", Mean: round6(1.75 / 3), DocFrequency: 3, DocShare: 1, Entropy: round6(entropy(1, 0.5, 0.25))},
+		{Topic: 2, Label: "T2", Mean: 0.25, DocFrequency: 2, DocShare: round6(2.0 / 3), Entropy: round6(entropy(0, 0.5, 0.25))},
+		{Topic: 3, Label: "T3", Mean: round6(0.5 / 3), DocFrequency: 1, DocShare: round6(1.0 / 3), Entropy: 0},
+	}
+	if !reflect.DeepEqual(stats.Topics, want) {
+		t.Errorf("topics %+v, want %+v", stats.Topics, want)
+	}
+	if want := [][]int{{3, 2, 1}, {2, 2, 1}, {1, 1, 1}}; !reflect.DeepEqual(stats.Cooccurrence, want) {
+		t.Errorf("cooccurrence %v, want %v", stats.Cooccurrence, want)
+	}
+	columns := [][]float64{{1, 0.5, 0.25}, {0, 0.5, 0.25}, {0, 0, 0.5}}
+	for i := range columns {
+		for j := range columns {
+			if want := pearson(columns[i], columns[j]); math.Abs(stats.Correlation[i][j]-want) > 1e-6 {
+				t.Errorf("correlation of topics %d and %d: %v, want %v", i+1, j+1, stats.Correlation[i][j], want)
+			}
+		}
+	}
+
+	higher, err := m.topicStats("", 0.3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]int{{2, 1, 0}, {1, 1, 0}, {0, 0, 1}}; !reflect.DeepEqual(higher.Cooccurrence, want) {
+		t.Errorf("cooccurrence at 0.3: %v, want %v", higher.Cooccurrence, want)
+	}
+	if again, _ := m.topicStats("", 0.25); again != stats {
+		t.Error("statistics were computed again rather than cached")
+	}
+}
+
+func TestTopicStatsOfWork(t *testing.T) {
+	m := statsModel()
+	stats, err := m.topicStats("urn:cts:x:a.b", 0.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Passages != 2 || stats.Topics[0].Mean != 0.75 || stats.Topics[2].DocFrequency != 0 {
+		t.Errorf("stats of urn:cts:x:a.b: %+v", stats)
+	}
+	// A topic that never varies correlates with nothing, itself included,
+	// and has no entropy to speak of.
+	if stats.Correlation[2][2] != 0 || stats.Correlation[0][2] != 0 || stats.Topics[2].Entropy != 0 {
+		t.Errorf("a topic absent from the work: correlation %v, entropy %v", stats.Correlation, stats.Topics[2].Entropy)
+	}
+	if stats.Correlation[0][1] != -1 {
+		t.Errorf("two topics that trade off correlate at %v", stats.Correlation[0][1])
+	}
+	if _, err := m.topicStats("urn:cts:x:e.f", 0.1); err == nil {
+		t.Error("statistics for a work without passages")
+	}
+}
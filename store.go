@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// ThetaStore holds the passages and their topic vectors. Handlers only talk
+// to this interface, so they work the same whether the data is kept in
+// memory or in metallo.db.
+type ThetaStore interface {
+	// Get looks up a single passage by ID.
+	Get(id string) (theta, error)
+	// Iterate calls fn for every passage in storage order and stops at the
+	// first error fn returns.
+	Iterate(fn func(t theta) error) error
+	// Vectors is like Iterate but skips passage texts, which is all a
+	// distance scan needs.
+	Vectors(fn func(id string, vector []float64) error) error
+	// Metadata returns the metadata fields of every passage that has any.
+	Metadata() (map[string]map[string]string, error)
+	Count() int
+	Topics() []string
+	Close() error
+}
+
+// allThetas returns every passage as a slice, for code that needs random
+// access such as the divergence exports.
+func allThetas(s ThetaStore) ([]theta, error) {
+	if m, ok := s.(*memoryStore); ok {
+		return m.thetas, nil
+	}
+	result := make([]theta, 0, s.Count())
+	err := s.Iterate(func(t theta) error {
+		result = append(result, t)
+		return nil
+	})
+	return result, err
+}
+
+// memoryStore keeps everything read from the theta file in a slice.
+type memoryStore struct {
+	thetas []theta
+	topics []string
+	byID   map[string]int
+}
+
+func newMemoryStore(thetas []theta, topics []string) *memoryStore {
+	byID := make(map[string]int, len(thetas))
+	for i, t := range thetas {
+		if _, ok := byID[t.ID]; !ok {
+			byID[t.ID] = i
+		}
+	}
+	return &memoryStore{thetas: thetas, topics: topics, byID: byID}
+}
+
+func (m *memoryStore) Get(id string) (theta, error) {
+	i, ok := m.byID[id]
+	if !ok {
+		return theta{}, fmt.Errorf("passage %q not found", id)
+	}
+	return m.thetas[i], nil
+}
+
+func (m *memoryStore) Iterate(fn func(t theta) error) error {
+	for _, t := range m.thetas {
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) Vectors(fn func(id string, vector []float64) error) error {
+	for _, t := range m.thetas {
+		if err := fn(t.ID, t.Vector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) Metadata() (map[string]map[string]string, error) {
+	meta := map[string]map[string]string{}
+	for _, t := range m.thetas {
+		if len(t.Meta) > 0 {
+			meta[t.ID] = t.Meta
+		}
+	}
+	return meta, nil
+}
+
+func (m *memoryStore) Count() int       { return len(m.thetas) }
+func (m *memoryStore) Topics() []string { return m.topics }
+func (m *memoryStore) Close() error     { return nil }
+
+// boltStore is the single handle on metallo.db. It is opened once in main
+// and shared by all handlers; every request runs in its own transaction, so
+// concurrent readers no longer queue up on the file lock.
+type boltStore struct {
+	db     *bolt.DB
+	topics []string
+}
+
+func openBoltStore(path string, timeout time.Duration) (*boltStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: timeout})
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %v", path, err)
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// View runs fn in a read-only transaction.
+func (s *boltStore) View(fn func(tx *bolt.Tx) error) error {
+	return s.db.View(fn)
+}
+
+// Update runs fn in a read-write transaction.
+func (s *boltStore) Update(fn func(tx *bolt.Tx) error) error {
+	return s.db.Update(fn)
+}
+
+// loadTopics reads the topic labels stored by -loadDB.
+func (s *boltStore) loadTopics() error {
+	return s.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("topics"))
+		if bucket == nil {
+			return fmt.Errorf("bucket %q not found", "topics")
+		}
+		topics, err := gobDecodeTopics(bucket.Get([]byte("topics")))
+		s.topics = topics
+		return err
+	})
+}
+
+func (s *boltStore) Topics() []string { return s.topics }
+
+func (s *boltStore) PutTopics(topics []string) error {
+	dbvalue, err := gobEncode(&topics)
+	if err != nil {
+		return err
+	}
+	err = s.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("topics"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("topics"), dbvalue)
+	})
+	if err == nil {
+		s.topics = topics
+	}
+	return err
+}
+
+func (s *boltStore) Get(id string) (result theta, err error) {
+	err = s.View(func(tx *bolt.Tx) error {
+		key := []byte(id)
+		val := tx.Bucket(vectorsBucket).Get(key)
+		if val == nil {
+			return fmt.Errorf("passage %q not found", id)
+		}
+		vector, err := decodeVector(val)
+		if err != nil {
+			return err
+		}
+		result = theta{ID: id, Text: string(tx.Bucket(textsBucket).Get(key)), Vector: vector, Meta: getMeta(tx, key)}
+		return nil
+	})
+	return result, err
+}
+
+func (s *boltStore) Iterate(fn func(t theta) error) error {
+	return s.View(func(tx *bolt.Tx) error {
+		texts := tx.Bucket(textsBucket)
+		return eachVector(tx, func(id string, vector []float64) error {
+			key := []byte(id)
+			return fn(theta{ID: id, Text: string(texts.Get(key)), Vector: vector, Meta: getMeta(tx, key)})
+		})
+	})
+}
+
+func (s *boltStore) Metadata() (map[string]map[string]string, error) {
+	meta := map[string]map[string]string{}
+	err := s.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(metaBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var fields map[string]string
+			if err := json.Unmarshal(v, &fields); err != nil {
+				log.Printf("decoding problem for metadata of %q: %v", k, err)
+				return nil
+			}
+			meta[string(k)] = fields
+			return nil
+		})
+	})
+	return meta, err
+}
+
+// putMeta stores the metadata of a passage. The meta bucket is created on
+// first use, so databases without metadata do not have one.
+func putMeta(tx *bolt.Tx, key []byte, meta map[string]string) error {
+	bucket, err := tx.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, encoded)
+}
+
+func getMeta(tx *bolt.Tx, key []byte) map[string]string {
+	bucket := tx.Bucket(metaBucket)
+	if bucket == nil {
+		return nil
+	}
+	var meta map[string]string
+	if v := bucket.Get(key); v != nil {
+		json.Unmarshal(v, &meta)
+	}
+	return meta
+}
+
+func (s *boltStore) Vectors(fn func(id string, vector []float64) error) error {
+	return s.View(func(tx *bolt.Tx) error {
+		return eachVector(tx, fn)
+	})
+}
+
+func eachVector(tx *bolt.Tx, fn func(id string, vector []float64) error) error {
+	c := tx.Bucket(vectorsBucket).Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		vector, err := decodeVector(v)
+		if err != nil {
+			log.Printf("decoding problem for %q: %v", k, err)
+			continue
+		}
+		if err := fn(string(k), vector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *boltStore) Count() (count int) {
+	s.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket(vectorsBucket).Stats().KeyN
+		return nil
+	})
+	return count
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+type topicWord struct {
+	Word   string  `json:"word"`
+	Weight float64 `json:"weight,omitempty"`
+}
+
+type topicPassage struct {
+	ID         string            `json:"id"`
+	Proportion float64           `json:"proportion"`
+	Text       string            `json:"text"`
+	Meta       map[string]string `json:"meta,omitempty"`
+}
+
+// topicSummary describes one topic: its top words, how much of the corpus
+// it accounts for and the passages where it is strongest. Under a topic
+// projection the passages are ranked by the share of the topic's group
+// (Group lists the merged topics), except for a masked topic, whose page
+// stays available for labeling and ranks by its own proportion.
+type topicSummary struct {
+	Topic      int            `json:"topic"` // numbered from 1
+	Label      string         `json:"label"`
+	Header     string         `json:"header"`
+	Note       string         `json:"note,omitempty"`
+	Alpha      float64        `json:"alpha,omitempty"`
+	Prevalence float64        `json:"prevalence"` // mean proportion over all passages, unprojected
+	Masked     bool           `json:"masked,omitempty"`
+	Group      []int          `json:"group,omitempty"`
+	Words      []topicWord    `json:"words"`
+	Passages   []topicPassage `json:"passages"`
+}
+
+// topicFromRequest reads the {topic} route variable, numbered from 1, and
+// returns the topic's index.
+func topicFromRequest(m *model, r *http.Request) (int, error) {
+	v := mux.Vars(r)["topic"]
+	topic, err := strconv.Atoi(v)
+	if err != nil || topic < 1 || topic > len(m.store.Topics()) {
+		return 0, fmt.Errorf("no topic %q; topics are numbered 1-%d", v, len(m.store.Topics()))
+	}
+	return topic - 1, nil
+}
+
+// prevalence is the mean proportion of each topic over all passages. It is
+// computed on first use.
+func (m *model) prevalence() []float64 {
+	m.prevalenceOnce.Do(func() {
+		sum := make([]float64, len(m.store.Topics()))
+		n := 0
+		m.store.Vectors(func(id string, vector []float64) error {
+			for k := range sum {
+				if k < len(vector) {
+					sum[k] += vector[k]
+				}
+			}
+			n++
+			return nil
+		})
+		for k := range sum {
+			if n > 0 {
+				sum[k] /= float64(n)
+			}
+		}
+		m.topicPrevalence = sum
+	})
+	return m.topicPrevalence
+}
+
+// topPassages ranks the passages keep allows by their proportion of topic
+// or, given a projection, by the renormalized share of its group.
+func (m *model) topPassages(topic, count int, keep func(id string) bool, projection *topicProjection) ([]theta, []float64) {
+	best := newTopK(count, true)
+	m.store.Vectors(func(id string, vector []float64) error {
+		if topic < len(vector) && (keep == nil || keep(id)) {
+			score := vector[topic]
+			if projection != nil {
+				score = round6(projection.share(vector, topic))
+			}
+			best.Offer(theta{ID: id, Vector: vector}, score)
+		}
+		return nil
+	})
+	thetas, values := best.Sorted()
+	return m.withTexts(thetas), values
+}
+
+// summarizeTopic describes a topic with up to words top words and passages
+// top passages.
+func (m *model) summarizeTopic(topic, words, passages int, keep func(id string) bool, projection *topicProjection) topicSummary {
+	summary := topicSummary{
+		Topic:      topic + 1,
+		Label:      m.topicLabel(topic),
+		Header:     m.store.Topics()[topic],
+		Note:       m.labels.get(topic + 1).Note,
+		Prevalence: m.prevalence()[topic],
+		Words:      []topicWord{},
+		Passages:   []topicPassage{},
+	}
+	if tw := m.words; tw != nil {
+		if tw.alphas != nil {
+			summary.Alpha = tw.alphas[topic]
+		}
+		for i, word := range tw.keys[topic] {
+			if i == words {
+				break
+			}
+			entry := topicWord{Word: word}
+			if tw.keyWeights != nil {
+				entry.Weight = tw.keyWeights[topic][i]
+			}
+			summary.Words = append(summary.Words, entry)
+		}
+	}
+	if projection != nil {
+		if g := projection.group[topic]; g < 0 {
+			summary.Masked, projection = true, nil
+		} else if members := projection.groups[g]; len(members) > 1 {
+			for _, t := range members {
+				summary.Group = append(summary.Group, t+1)
+			}
+		}
+	}
+	thetas, values := m.topPassages(topic, passages, keep, projection)
+	for i, t := range thetas {
+		summary.Passages = append(summary.Passages, topicPassage{ID: t.ID, Proportion: values[i], Text: t.Text, Meta: t.Meta})
+	}
+	return summary
+}
+
+// topicSummaryFromRequest answers /topic/{topic} requests, which take
+// words=N (default 20) top words, passages=N (default 10) top passages and
+// filter=, mask= and merge= options as for neighbor queries.
+func topicSummaryFromRequest(w http.ResponseWriter, r *http.Request, m *model) (topicSummary, bool) {
+	topic, err := topicFromRequest(m, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return topicSummary{}, false
+	}
+	query := r.URL.Query()
+	counts := map[string]int{"words": 20, "passages": 10}
+	for name := range counts {
+		if v := query.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, name+" must be a number", http.StatusBadRequest)
+				return topicSummary{}, false
+			}
+			counts[name] = n
+		}
+	}
+	keep, err := m.metaFilters(query["filter"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return topicSummary{}, false
+	}
+	projection, err := m.projectionFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return topicSummary{}, false
+	}
+	return m.summarizeTopic(topic, counts["words"], counts["passages"], keep, projection), true
+}
+
+// ViewTopicJSON describes a topic as JSON.
+func ViewTopicJSON(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	m, release := modelFromRequest(w, r)
+	defer release()
+	if m == nil {
+		return
+	}
+	summary, ok := topicSummaryFromRequest(w, r, m)
+	if !ok {
+		return
+	}
+	resultJSON, _ := json.Marshal(summary)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintln(w, string(resultJSON))
+}
+
+// TopicPage is what topic.html shows.
+type TopicPage struct {
+	topicSummary
+	Address  string
+	Base     string // Address, plus the model prefix if the page has one
+	Share    string // prevalence as a percentage
+	Rows     []topicRow
+	Previous int
+	Next     int
+}
+
+type topicRow struct {
+	Rank  int
+	ID    string
+	Share string
+	Text  string
+}
+
+// ViewTopicPage shows a topic for browsing.
+func ViewTopicPage(w http.ResponseWriter, r *http.Request) {
+	m, release := modelFromRequest(w, r)
+	defer release()
+	if m == nil {
+		return
+	}
+	summary, ok := topicSummaryFromRequest(w, r, m)
+	if !ok {
+		return
+	}
+	percent := func(v float64) string { return strconv.FormatFloat(v*m.config.DimWeight, 'f', 2, 64) }
+	p := &TopicPage{topicSummary: summary, Address: m.config.Host, Base: pageBase(m, r), Share: percent(summary.Prevalence)}
+	for i, passage := range summary.Passages {
+		p.Rows = append(p.Rows, topicRow{Rank: i + 1, ID: passage.ID, Share: percent(passage.Proportion), Text: passage.Text})
+	}
+	if summary.Topic > 1 {
+		p.Previous = summary.Topic - 1
+	}
+	if summary.Topic < len(m.store.Topics()) {
+		p.Next = summary.Topic + 1
+	}
+	renderTemplate(w, "topic", p)
+}
+
+type rankedPassage struct {
+	Rank       int               `json:"rank"`
+	ID         string            `json:"id"`
+	Proportion float64           `json:"proportion"`
+	Text       string            `json:"text"`
+	Meta       map[string]string `json:"meta,omitempty"`
+}
+
+// topicRanking is one page of the passages ranked by a topic's proportion.
+type topicRanking struct {
+	Topic         int             `json:"topic"` // numbered from 1
+	Label         string          `json:"label"`
+	Count         int             `json:"count"`
+	Offset        int             `json:"offset"`
+	MinProportion float64         `json:"minProportion,omitempty"`
+	Items         []rankedPassage `json:"items"`
+}
+
+// topicRankingFromRequest returns a page of {count} passages from the
+// ranking of {topic}, shaped by the options:
+//
+//	offset=N         start after the first N ranks, to page through the topic
+//	limit=N          return at most N passages, if fewer than {count}
+//	minProportion=P  leave out passages with less than P of the topic
+//	filter=F         as for neighbor queries
+//	mask=, merge=    hide or merge topics, as for neighbor queries
+//
+// Ranks count from 1 over the whole ranking, not the page. Under a
+// projection passages are ranked by the share of the topic's group.
+func topicRankingFromRequest(w http.ResponseWriter, r *http.Request, m *model) (topicRanking, bool) {
+	topic, err := topicFromRequest(m, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return topicRanking{}, false
+	}
+	query := r.URL.Query()
+	ranking := topicRanking{Topic: topic + 1, Label: m.topicLabel(topic), Items: []rankedPassage{}}
+	ranking.Count, err = strconv.Atoi(mux.Vars(r)["count"])
+	if err != nil || ranking.Count < 0 {
+		http.Error(w, "count must be a number", http.StatusBadRequest)
+		return ranking, false
+	}
+	limit := ranking.Count
+	for name, target := range map[string]*int{"offset": &ranking.Offset, "limit": &limit} {
+		if v := query.Get(name); v != "" {
+			if *target, err = strconv.Atoi(v); err != nil || *target < 0 {
+				http.Error(w, name+" must be a number", http.StatusBadRequest)
+				return ranking, false
+			}
+		}
+	}
+	if limit > ranking.Count {
+		limit = ranking.Count
+	}
+	if v := query.Get("minProportion"); v != "" {
+		if ranking.MinProportion, err = strconv.ParseFloat(v, 64); err != nil {
+			http.Error(w, "minProportion must be a number", http.StatusBadRequest)
+			return ranking, false
+		}
+	}
+	keep, err := m.metaFilters(query["filter"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return ranking, false
+	}
+	projection, err := m.projectionFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return ranking, false
+	}
+	if projection != nil && projection.group[topic] < 0 {
+		http.Error(w, fmt.Sprintf("topic %d is masked", topic+1), http.StatusBadRequest)
+		return ranking, false
+	}
+	thetas, values := m.topPassages(topic, ranking.Offset+limit, keep, projection)
+	for i := ranking.Offset; i < len(thetas) && len(ranking.Items) < limit; i++ {
+		if values[i] < ranking.MinProportion {
+			break
+		}
+		t := thetas[i]
+		ranking.Items = append(ranking.Items, rankedPassage{Rank: i + 1, ID: t.ID, Proportion: values[i], Text: t.Text, Meta: t.Meta})
+	}
+	return ranking, true
+}
+
+// ViewTopicRankingJSON lists the passages strongest in a topic as JSON.
+func ViewTopicRankingJSON(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	m, release := modelFromRequest(w, r)
+	defer release()
+	if m == nil {
+		return
+	}
+	ranking, ok := topicRankingFromRequest(w, r, m)
+	if !ok {
+		return
+	}
+	resultJSON, _ := json.Marshal(ranking)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintln(w, string(resultJSON))
+}
+
+// ViewTopicRankingCSV lists the passages strongest in a topic as CSV with
+// the columns rank, id, proportion and text.
+func ViewTopicRankingCSV(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	m, release := modelFromRequest(w, r)
+	defer release()
+	if m == nil {
+		return
+	}
+	ranking, ok := topicRankingFromRequest(w, r, m)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"topic%d.csv\"", ranking.Topic))
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"rank", "id", "proportion", "text"})
+	for _, item := range ranking.Items {
+		writer.Write([]string{strconv.Itoa(item.Rank), item.ID, strconv.FormatFloat(item.Proportion, 'f', -1, 64), item.Text})
+	}
+	writer.Flush()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// rankingModel has six passages whose share of topic 1 falls from p1 to p6.
+func rankingModel() *model {
+	proportions := map[string]float64{"p4": 0.6, "p1": 0.9, "p6": 0.1, "p3": 0.7, "p5": 0.5, "p2": 0.8}
+	var thetas []theta
+	for id, p := range proportions {
+		thetas = append(thetas, theta{ID: id, Vector: []float64{p, 1 - p}})
+	}
+	return &model{
+		store:  newMemoryStore(thetas, []string{"T1", "T2"}),
+		labels: &labelStore{labels: map[int]topicLabel{}},
+	}
+}
+
+func TestTopicRankingPages(t *testing.T) {
+	m := rankingModel()
+	cases := []struct {
+		topic, count, query string
+		status              int
+		want                []string // rank and ID of each item
+	}{
+		{"1", "3", "", http.StatusOK, []string{"1 p1", "2 p2", "3 p3"}},
+		{"2", "2", "", http.StatusOK, []string{"1 p6", "2 p5"}},
+		{"1", "3", "offset=2", http.StatusOK, []string{"3 p3", "4 p4", "5 p5"}},
+		{"1", "3", "offset=5", http.StatusOK, []string{"6 p6"}},
+		{"1", "3", "offset=6", http.StatusOK, nil},
+		{"1", "3", "offset=100", http.StatusOK, nil},
+		{"1", "3", "limit=2", http.StatusOK, []string{"1 p1", "2 p2"}},
+		{"1", "3", "limit=5", http.StatusOK, []string{"1 p1", "2 p2", "3 p3"}}, // limit only lowers count
+		{"1", "3", "limit=0", http.StatusOK, nil},
+		{"1", "0", "", http.StatusOK, nil},
+		{"1", "10", "minProportion=0.6", http.StatusOK, []string{"1 p1", "2 p2", "3 p3", "4 p4"}}, // the bound itself is kept
+		{"1", "10", "minProportion=0.65&offset=1", http.StatusOK, []string{"2 p2", "3 p3"}},
+		{"1", "2", "minProportion=0.95", http.StatusOK, nil},
+		{"1", "3", "offset=-1", http.StatusBadRequest, nil},
+		{"1", "3", "offset=one", http.StatusBadRequest, nil},
+		{"1", "3", "limit=-2", http.StatusBadRequest, nil},
+		{"1", "-1", "", http.StatusBadRequest, nil},
+		{"1", "3", "minProportion=most", http.StatusBadRequest, nil},
+		{"1", "3", "mask=1", http.StatusBadRequest, nil},
+		{"0", "3", "", http.StatusNotFound, nil},
+		{"3", "3", "", http.StatusNotFound, nil},
+		{"T1", "3", "", http.StatusNotFound, nil},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/topic/"+c.topic+"/passages/"+c.count+"/json?"+c.query, nil)
+		r = mux.SetURLVars(r, map[string]string{"topic": c.topic, "count": c.count})
+		w := httptest.NewRecorder()
+		ranking, ok := topicRankingFromRequest(w, r, m)
+		if ok != (c.status == http.StatusOK) || (!ok && w.Code != c.status) {
+			t.Errorf("topic %s, count %s, %q: status %d, want %d", c.topic, c.count, c.query, w.Code, c.status)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		var got []string
+		for _, item := range ranking.Items {
+			got = append(got, strconv.Itoa(item.Rank)+" "+item.ID)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("topic %s, count %s, %q: %v, want %v", c.topic, c.count, c.query, got, c.want)
+		}
+		if ranking.Items == nil {
+			t.Errorf("topic %s, count %s, %q: items are null rather than empty", c.topic, c.count, c.query)
+		}
+	}
+}
+
+func TestPrevalence(t *testing.T) {
+	m := rankingModel()
+	got := m.prevalence()
+	if len(got) != 2 || math.Abs(got[0]-0.6) > 1e-12 || math.Abs(got[1]-0.4) > 1e-12 {
+		t.Errorf("prevalence %v, want [0.6 0.4]", got)
+	}
+	empty := &model{store: newMemoryStore(nil, []string{"T1", "T2"})}
+	if got := empty.prevalence(); !reflect.DeepEqual(got, []float64{0, 0}) {
+		t.Errorf("prevalence without passages %v", got)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"container/heap"
+	"sort"
+)
+
+type scoredTheta struct {
+	Theta theta
+	Score float64
+}
+
+// topK keeps the k best passages seen so far in a bounded heap whose root
+// is the worst retained entry. By default lower scores are better (as with
+// distances); highest flips that for rankings such as topic proportions.
+// Equal scores are broken by ID so results do not depend on scan order.
+type topK struct {
+	k       int
+	highest bool
+	entries []scoredTheta
+}
+
+func newTopK(k int, highest bool) *topK {
+	if k < 0 {
+		k = 0
+	}
+	return &topK{k: k, highest: highest}
+}
+
+// better reports whether a ranks ahead of b.
+func (t *topK) better(a, b scoredTheta) bool {
+	if a.Score != b.Score {
+		if t.highest {
+			return a.Score > b.Score
+		}
+		return a.Score < b.Score
+	}
+	return a.Theta.ID < b.Theta.ID
+}
+
+func (t *topK) Len() int           { return len(t.entries) }
+func (t *topK) Less(i, j int) bool { return t.better(t.entries[j], t.entries[i]) }
+func (t *topK) Swap(i, j int)      { t.entries[i], t.entries[j] = t.entries[j], t.entries[i] }
+func (t *topK) Push(x interface{}) { t.entries = append(t.entries, x.(scoredTheta)) }
+func (t *topK) Pop() interface{} {
+	last := t.entries[len(t.entries)-1]
+	t.entries = t.entries[:len(t.entries)-1]
+	return last
+}
+
+// Offer considers a candidate and reports whether it was kept.
+func (t *topK) Offer(th theta, score float64) bool {
+	entry := scoredTheta{Theta: th, Score: score}
+	if len(t.entries) < t.k {
+		heap.Push(t, entry)
+		return true
+	}
+	if t.k == 0 || !t.better(entry, t.entries[0]) {
+		return false
+	}
+	t.entries[0] = entry
+	heap.Fix(t, 0)
+	return true
+}
+
+// Full reports whether k entries are held.
+func (t *topK) Full() bool { return len(t.entries) >= t.k }
+
+// Worst returns the score a candidate has to beat once the heap is full.
+func (t *topK) Worst() float64 { return t.entries[0].Score }
+
+// Sorted returns the retained passages best first, with their scores.
+func (t *topK) Sorted() ([]theta, []float64) {
+	entries := make([]scoredTheta, len(t.entries))
+	copy(entries, t.entries)
+	sort.Slice(entries, func(i, j int) bool { return t.better(entries[i], entries[j]) })
+	thetas := make([]theta, len(entries))
+	scores := make([]float64, len(entries))
+	for i, e := range entries {
+		thetas[i] = e.Theta
+		scores[i] = e.Score
+	}
+	return thetas, scores
+}
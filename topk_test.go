@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func offerAll(t *topK, scores map[string]float64, order []string) []string {
+	for _, id := range order {
+		t.Offer(theta{ID: id}, scores[id])
+	}
+	thetas, _ := t.Sorted()
+	ids := make([]string, len(thetas))
+	for i, th := range thetas {
+		ids[i] = th.ID
+	}
+	return ids
+}
+
+func TestTopKLowestFirst(t *testing.T) {
+	scores := map[string]float64{"a": 0.5, "b": 0.1, "c": 0.9, "d": 0.3, "e": 0.2}
+	got := offerAll(newTopK(3, false), scores, []string{"a", "b", "c", "d", "e"})
+	if want := []string{"b", "e", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestTopKHighestFirst(t *testing.T) {
+	scores := map[string]float64{"a": 0.5, "b": 0.1, "c": 0.9, "d": 0.3}
+	tk := newTopK(2, true)
+	got := offerAll(tk, scores, []string{"a", "b", "c", "d"})
+	if want := []string{"c", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if !tk.Full() || tk.Worst() != 0.5 {
+		t.Errorf("Full() = %v, Worst() = %v; want true, 0.5", tk.Full(), tk.Worst())
+	}
+}
+
+// Ties are broken by ID, whatever order the candidates arrive in.
+func TestTopKTiesByID(t *testing.T) {
+	scores := map[string]float64{"d": 1, "b": 1, "a": 1, "c": 1, "e": 0}
+	for _, order := range [][]string{{"a", "b", "c", "d", "e"}, {"e", "d", "c", "b", "a"}, {"c", "a", "e", "d", "b"}} {
+		got := offerAll(newTopK(3, true), scores, order)
+		if want := []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("order %v: got %v, want %v", order, got, want)
+		}
+	}
+}
+
+func TestTopKEmpty(t *testing.T) {
+	tk := newTopK(0, false)
+	if tk.Offer(theta{ID: "a"}, 1) {
+		t.Error("a heap of size 0 kept a candidate")
+	}
+	if thetas, scores := tk.Sorted(); len(thetas) != 0 || len(scores) != 0 {
+		t.Errorf("got %v %v, want nothing", thetas, scores)
+	}
+	got := offerAll(newTopK(5, false), map[string]float64{"a": 2, "b": 1}, []string{"a", "b"})
+	if want := []string{"b", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("fewer candidates than k: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+type trajectoryPoint struct {
+	Position int       `json:"position"` // from 1, in citation order
+	ID       string    `json:"id"`
+	Vector   []float64 `json:"vector"`
+}
+
+// trajectory follows the topic proportions through a work or range,
+// passage by passage in citation order.
+type trajectory struct {
+	URN    string            `json:"urn"`
+	Smooth int               `json:"smooth"`
+	Topics []string          `json:"topics"`
+	Points []trajectoryPoint `json:"points"`
+}
+
+// passagesUnder lists the passages a CTS URN covers or, for anything else,
+// those whose IDs start with it, in citation order.
+func (m *model) passagesUnder(prefix string) []string {
+	if u, err := parseURN(prefix); err == nil {
+		return m.passagesIn(u)
+	}
+	var ids []string
+	m.store.Vectors(func(id string, vector []float64) error {
+		if strings.HasPrefix(id, prefix) {
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	sortByCitation(ids)
+	return ids
+}
+
+// trajectory collects the vectors of the passages under urn and, if smooth
+// is above 1, replaces each by the mean over a window of smooth passages
+// centered on it. Windows are cut short at either end of the text.
+func (m *model) trajectory(urn string, smooth int) (trajectory, error) {
+	result := trajectory{URN: urn, Smooth: smooth, Topics: m.topicLabels()}
+	ids := m.passagesUnder(urn)
+	if len(ids) == 0 {
+		return result, fmt.Errorf("no passages in %s", urn)
+	}
+	vectors := make([][]float64, len(ids))
+	for i, id := range ids {
+		t, err := m.store.Get(id)
+		if err != nil {
+			return result, err
+		}
+		vectors[i] = t.Vector
+	}
+	before, after := 0, 0
+	if smooth > 1 {
+		before, after = (smooth-1)/2, smooth/2
+	}
+	for i, id := range ids {
+		first, last := i-before, i+after
+		if first < 0 {
+			first = 0
+		}
+		if last >= len(ids) {
+			last = len(ids) - 1
+		}
+		mean := make([]float64, len(vectors[i]))
+		for j := first; j <= last; j++ {
+			for k := range mean {
+				if k < len(vectors[j]) {
+					mean[k] += vectors[j][k]
+				}
+			}
+		}
+		for k := range mean {
+			mean[k] = round6(mean[k] / float64(last-first+1))
+		}
+		result.Points = append(result.Points, trajectoryPoint{Position: i + 1, ID: id, Vector: mean})
+	}
+	return result, nil
+}
+
+// trajectoryFromRequest reads {urn} and ?smooth=N, the number of passages
+// to average over (default 1, no smoothing).
+func trajectoryFromRequest(w http.ResponseWriter, r *http.Request, m *model) (trajectory, bool) {
+	smooth := 1
+	if v := r.URL.Query().Get("smooth"); v != "" {
+		var err error
+		if smooth, err = strconv.Atoi(v); err != nil || smooth < 1 {
+			http.Error(w, "smooth must be a number of passages", http.StatusBadRequest)
+			return trajectory{}, false
+		}
+	}
+	result, err := m.trajectory(mux.Vars(r)["urn"], smooth)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return result, false
+	}
+	return result, true
+}
+
+// ViewTrajectoryJSON returns a trajectory as JSON.
+func ViewTrajectoryJSON(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	m, release := modelFromRequest(w, r)
+	defer release()
+	if m == nil {
+		return
+	}
+	result, ok := trajectoryFromRequest(w, r, m)
+	if !ok {
+		return
+	}
+	resultJSON, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintln(w, string(resultJSON))
+}
+
+// ViewTrajectoryCSV returns a trajectory as CSV: position, passage ID and a
+// column per topic.
+func ViewTrajectoryCSV(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	m, release := modelFromRequest(w, r)
+	defer release()
+	if m == nil {
+		return
+	}
+	result, ok := trajectoryFromRequest(w, r, m)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"trajectory.csv\"")
+	writer := csv.NewWriter(w)
+	writer.Write(append([]string{"position", "id"}, result.Topics...))
+	for _, p := range result.Points {
+		row := []string{strconv.Itoa(p.Position), p.ID}
+		for _, v := range p.Vector {
+			row = append(row, strconv.FormatFloat(v, 'f', -1, 64))
+		}
+		writer.Write(row)
+	}
+	writer.Flush()
+}
+
+// TrajectoryPage is what trajectory.html shows.
+type TrajectoryPage struct {
+	URN     string
+	Smooth  int
+	Address string
+	Base    string // Address, plus the model prefix if the page has one
+	JSON    template.JS
+}
+
+// ViewTrajectoryPage draws a trajectory as a stacked area chart.
+func ViewTrajectoryPage(w http.ResponseWriter, r *http.Request) {
+	m, release := modelFromRequest(w, r)
+	defer release()
+	if m == nil {
+		return
+	}
+	result, ok := trajectoryFromRequest(w, r, m)
+	if !ok {
+		return
+	}
+	resultJSON, _ := json.Marshal(result)
+	renderTemplate(w, "trajectory", &TrajectoryPage{URN: result.URN, Smooth: result.Smooth, Address: m.config.Host, Base: pageBase(m, r), JSON: template.JS(resultJSON)})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// trajectoryModel has four passages of urn:cts:x:a.b, where topic 1 runs
+// 1, 0, 0.5, 0.25 in citation order, one of urn:cts:x:c.d and two without
+// a CTS URN.
+func trajectoryModel() *model {
+	thetas := []theta{
+		{ID: "urn:cts:x:a.b:1.10", Vector: []float64{0.25, 0.75}},
+		{ID: "urn:cts:x:a.b:1.2", Vector: []float64{0, 1}},
+		{ID: "urn:cts:x:c.d:1.1", Vector: []float64{0.3, 0.7}},
+		{ID: "urn:cts:x:a.b:1.9", Vector: []float64{0.5, 0.5}},
+		{ID: "urn:cts:x:a.b:1.1", Vector: []float64{1, 0}},
+		{ID: "NBhu_2", Vector: []float64{0, 1}},
+		{ID: "NBhu_1", Vector: []float64{1, 0}},
+	}
+	return &model{
+		store:  newMemoryStore(thetas, []string{"T1", "T2"}),
+		labels: &labelStore{labels: map[int]topicLabel{2: {Label: "Sea"}}},
+		work:   ctsWork,
+	}
+}
+
+func TestTrajectorySmoothing(t *testing.T) {
+	m := trajectoryModel()
+	cases := []struct {
+		urn    string
+		smooth int
+		ids    []string
+		topic1 []float64
+	}{
+		{"urn:cts:x:a.b", 1, []string{"urn:cts:x:a.b:1.1", "urn:cts:x:a.b:1.2", "urn:cts:x:a.b:1.9", "urn:cts:x:a.b:1.10"}, []float64{1, 0, 0.5, 0.25}},
+		{"urn:cts:x:a.b", 0, nil, []float64{1, 0, 0.5, 0.25}},
+		// An even window reaches one passage further ahead than back.
+		{"urn:cts:x:a.b", 2, nil, []float64{0.5, 0.25, 0.375, 0.25}},
+		// Windows are cut short at either end.
+		{"urn:cts:x:a.b", 3, nil, []float64{0.5, 0.5, 0.25, 0.375}},
+		{"urn:cts:x:a.b", 4, nil, []float64{0.5, 0.4375, 0.25, 0.375}},
+		// A window wider than the text averages all of it everywhere.
+		{"urn:cts:x:a.b", 10, nil, []float64{0.4375, 0.4375, 0.4375, 0.4375}},
+		// A range is smoothed within itself, not with its neighbors.
+		{"urn:cts:x:a.b:1.2-1.9", 3, []string{"urn:cts:x:a.b:1.2", "urn:cts:x:a.b:1.9"}, []float64{0.25, 0.25}},
+		{"urn:cts:x:c.d", 5, []string{"urn:cts:x:c.d:1.1"}, []float64{0.3}},
+		{"NBhu", 2, []string{"NBhu_1", "NBhu_2"}, []float64{0.5, 0}},
+	}
+	for _, c := range cases {
+		result, err := m.trajectory(c.urn, c.smooth)
+		if err != nil {
+			t.Errorf("%s smoothed over %d: %v", c.urn, c.smooth, err)
+			continue
+		}
+		if !reflect.DeepEqual(result.Topics, []string{"T1", "Sea"}) || result.Smooth != c.smooth {
+			t.Errorf("%s smoothed over %d: topics %v, smooth %d", c.urn, c.smooth, result.Topics, result.Smooth)
+		}
+		if len(result.Points) != len(c.topic1) {
+			t.Errorf("%s smoothed over %d: %d points, want %d", c.urn, c.smooth, len(result.Points), len(c.topic1))
+			continue
+		}
+		for i, p := range result.Points {
+			if p.Position != i+1 || (c.ids != nil && p.ID != c.ids[i]) {
+				t.Errorf("%s smoothed over %d: point %d is %s at %d", c.urn, c.smooth, i, p.ID, p.Position)
+			}
+			if p.Vector[0] != c.topic1[i] || math.Abs(p.Vector[0]+p.Vector[1]-1) > 1e-6 {
+				t.Errorf("%s smoothed over %d: point %d is %v, want topic 1 at %v", c.urn, c.smooth, i+1, p.Vector, c.topic1[i])
+			}
+		}
+	}
+	if _, err := m.trajectory("urn:cts:x:e.f", 1); err == nil {
+		t.Error("a trajectory through a work without passages")
+	}
+}
+
+func TestTrajectoryFromRequest(t *testing.T) {
+	m := trajectoryModel()
+	cases := []struct {
+		urn, query string
+		status     int
+	}{
+		{"urn:cts:x:a.b", "", http.StatusOK},
+		{"urn:cts:x:a.b", "smooth=3", http.StatusOK},
+		{"urn:cts:x:a.b", "smooth=0", http.StatusBadRequest},
+		{"urn:cts:x:a.b", "smooth=-2", http.StatusBadRequest},
+		{"urn:cts:x:a.b", "smooth=wide", http.StatusBadRequest},
+		{"urn:cts:x:e.f", "", http.StatusNotFound},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/trajectory/"+c.urn+"/json?"+c.query, nil)
+		r = mux.SetURLVars(r, map[string]string{"urn": c.urn})
+		w := httptest.NewRecorder()
+		result, ok := trajectoryFromRequest(w, r, m)
+		if ok != (c.status == http.StatusOK) || (!ok && w.Code != c.status) {
+			t.Errorf("%s?%s: status %d, want %d", c.urn, c.query, w.Code, c.status)
+		}
+		if ok && result.Smooth < 1 {
+			t.Errorf("%s?%s: smooth %d", c.urn, c.query, result.Smooth)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// ctsURN is a parsed CTS URN such as
+//
+//	urn:cts:greekLit:tlg0001.tlg001.perseus-grc1:1.1-1.20
+//
+// with the work component split into its parts and the passage component
+// into citation levels. A single passage has Start and End equal; a work
+// URN has neither.
+type ctsURN struct {
+	Namespace string
+	TextGroup string
+	Work      string
+	Version   string
+	Exemplar  string
+	Start     []string
+	End       []string
+}
+
+// parseURN parses a CTS URN. Subreferences (@word) are ignored.
+func parseURN(s string) (ctsURN, error) {
+	var u ctsURN
+	parts := strings.SplitN(s, ":", 5)
+	if len(parts) < 4 || parts[0] != "urn" || parts[1] != "cts" || parts[2] == "" || parts[3] == "" {
+		return u, fmt.Errorf("%q is not a CTS URN", s)
+	}
+	u.Namespace = parts[2]
+	work := strings.Split(parts[3], ".")
+	if len(work) > 4 {
+		return u, fmt.Errorf("%q has too many work levels", s)
+	}
+	work = append(work, "", "", "")
+	u.TextGroup, u.Work, u.Version, u.Exemplar = work[0], work[1], work[2], work[3]
+	if len(parts) == 5 && parts[4] != "" {
+		passage := strings.SplitN(parts[4], "-", 2)
+		u.Start = citation(passage[0])
+		u.End = u.Start
+		if len(passage) == 2 {
+			u.End = citation(passage[1])
+		}
+		if len(u.Start) == 0 || len(u.End) == 0 {
+			return u, fmt.Errorf("%q has an empty passage reference", s)
+		}
+	}
+	return u, nil
+}
+
+func citation(ref string) []string {
+	if i := strings.Index(ref, "@"); i >= 0 {
+		ref = ref[:i]
+	}
+	if ref == "" {
+		return nil
+	}
+	return strings.Split(ref, ".")
+}
+
+// WorkID is the URN of the work, without version and passage.
+func (u ctsURN) WorkID() string {
+	id := "urn:cts:" + u.Namespace + ":" + u.TextGroup
+	if u.Work != "" {
+		id += "." + u.Work
+	}
+	return id
+}
+
+// contains reports whether the passage p lies within u: same work (and
+// version or exemplar, where u names one) and a citation between u's start
+// and end. Coarser references contain all finer ones below them, so 1
+// contains 1.1 and 1.1-1.2 contains 1.2.5.
+func (u ctsURN) contains(p ctsURN) bool {
+	if u.Namespace != p.Namespace || u.TextGroup != p.TextGroup {
+		return false
+	}
+	for _, level := range [][2]string{{u.Work, p.Work}, {u.Version, p.Version}, {u.Exemplar, p.Exemplar}} {
+		if level[0] != "" && level[0] != level[1] {
+			return false
+		}
+	}
+	if u.Start == nil {
+		return true
+	}
+	if p.Start == nil {
+		return false
+	}
+	return compareCitations(truncate(p.Start, len(u.Start)), u.Start) >= 0 &&
+		compareCitations(truncate(p.Start, len(u.End)), u.End) <= 0
+}
+
+func truncate(levels []string, n int) []string {
+	if len(levels) > n {
+		return levels[:n]
+	}
+	return levels
+}
+
+// compareCitations orders citations level by level, numerically where both
+// levels are numbers (so 2 comes before 10); a citation comes before those
+// it is a prefix of.
+func compareCitations(a, b []string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := compareLevel(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+func compareLevel(a, b string) int {
+	x, errA := strconv.Atoi(a)
+	y, errB := strconv.Atoi(b)
+	switch {
+	case errA == nil && errB == nil:
+		return x - y
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// citationKey is a passage ID parsed once for sorting.
+type citationKey struct {
+	id  string
+	urn ctsURN
+	ok  bool
+}
+
+func newCitationKey(id string) citationKey {
+	u, err := parseURN(id)
+	return citationKey{id: id, urn: u, ok: err == nil}
+}
+
+// compareKeys orders passage IDs canonically: CTS URNs by work, version
+// and citation, anything else after them by plain string order.
+func compareKeys(a, b citationKey) int {
+	switch {
+	case !a.ok && !b.ok:
+		return strings.Compare(a.id, b.id)
+	case !a.ok:
+		return 1
+	case !b.ok:
+		return -1
+	}
+	ua, ub := a.urn, b.urn
+	for _, level := range [][2]string{
+		{ua.Namespace, ub.Namespace}, {ua.TextGroup, ub.TextGroup}, {ua.Work, ub.Work},
+		{ua.Version, ub.Version}, {ua.Exemplar, ub.Exemplar}} {
+		if c := strings.Compare(level[0], level[1]); c != 0 {
+			return c
+		}
+	}
+	if c := compareCitations(ua.Start, ub.Start); c != 0 {
+		return c
+	}
+	return strings.Compare(a.id, b.id)
+}
+
+// sortByCitation sorts IDs in canonical citation order.
+func sortByCitation(ids []string) {
+	keys := make([]citationKey, len(ids))
+	for i, id := range ids {
+		keys[i] = newCitationKey(id)
+	}
+	sort.Slice(keys, func(i, j int) bool { return compareKeys(keys[i], keys[j]) < 0 })
+	for i, k := range keys {
+		ids[i] = k.id
+	}
+}
+
+// passagesIn lists the stored passages a work or range URN covers, in
+// citation order.
+func (m *model) passagesIn(u ctsURN) []string {
+	var ids []string
+	m.store.Vectors(func(id string, vector []float64) error {
+		if p, err := parseURN(id); err == nil && u.contains(p) {
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	sortByCitation(ids)
+	return ids
+}
+
+// resolveQuery looks up the passage to find neighbors for. A URN that is
+// not stored itself, such as a work, a book or a range, stands for the
+// passages it covers: the query is their mean vector and their texts, and members
+// lists them. members is nil for a single stored passage.
+func (m *model) resolveQuery(urn string) (query theta, members []string, err error) {
+	query, err = m.store.Get(urn)
+	if err == nil {
+		return query, nil, nil
+	}
+	u, perr := parseURN(urn)
+	if perr != nil {
+		return query, nil, err
+	}
+	members = m.passagesIn(u)
+	if len(members) == 0 {
+		return query, nil, fmt.Errorf("no passages in %s", urn)
+	}
+	query, err = m.centroid(urn, members)
+	return query, members, err
+}
+
+// centroid averages the vectors of the given passages and joins their texts.
+func (m *model) centroid(id string, members []string) (theta, error) {
+	result := theta{ID: id}
+	var texts []string
+	for _, member := range members {
+		t, err := m.store.Get(member)
+		if err != nil {
+			return result, err
+		}
+		if result.Vector == nil {
+			result.Vector = make([]float64, len(t.Vector))
+		}
+		for i := range result.Vector {
+			if i < len(t.Vector) {
+				result.Vector[i] += t.Vector[i]
+			}
+		}
+		texts = append(texts, t.Text)
+	}
+	for i := range result.Vector {
+		result.Vector[i] /= float64(len(members))
+	}
+	result.Text = strings.Join(texts, "\n")
+	return result, nil
+}
+
+// ViewPassages lists the stored passages a work or range URN covers, in
+// citation order.
+func ViewPassages(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	m, release := modelFromRequest(w, r)
+	defer release()
+	if m == nil {
+		return
+	}
+	urn := mux.Vars(r)["urn"]
+	u, err := parseURN(urn)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result := struct {
+		URN      string   `json:"urn"`
+		Work     string   `json:"work"`
+		Passages []string `json:"passages"`
+	}{URN: urn, Work: u.WorkID(), Passages: m.passagesIn(u)}
+	if result.Passages == nil {
+		result.Passages = []string{}
+	}
+	resultJSON, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintln(w, string(resultJSON))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseURN(t *testing.T) {
+	u, err := parseURN("urn:cts:greekLit:tlg0001.tlg001.perseus-grc1:1.1-1.20@μῆνιν")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ctsURN{
+		Namespace: "greekLit", TextGroup: "tlg0001", Work: "tlg001", Version: "perseus-grc1",
+		Start: []string{"1", "1"}, End: []string{"1", "20"},
+	}
+	if !reflect.DeepEqual(u, want) {
+		t.Errorf("got %+v, want %+v", u, want)
+	}
+	if id := u.WorkID(); id != "urn:cts:greekLit:tlg0001.tlg001" {
+		t.Errorf("WorkID() = %q", id)
+	}
+
+	work, err := parseURN("urn:cts:greekLit:tlg0001.tlg001")
+	if err != nil || work.Start != nil || work.End != nil {
+		t.Errorf("work URN: %+v, %v", work, err)
+	}
+	for _, bad := range []string{"", "tlg0001", "urn:cts:greekLit", "urn:isbn:123:4", "urn:cts:greekLit:a.b.c.d.e:1", "urn:cts:greekLit:tlg0001.tlg001:-2"} {
+		if _, err := parseURN(bad); err == nil {
+			t.Errorf("parseURN(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestCompareCitations(t *testing.T) {
+	cases := []struct {
+		a, b string
+		sign int
+	}{
+		{"1.2", "1.10", -1}, // numerically, not as strings
+		{"1.10", "1.2", 1},
+		{"1", "1.1", -1}, // a prefix comes first
+		{"2.1", "2.1", 0},
+		{"1.a", "1.b", -1},
+		{"1.5", "1.a", -1}, // numbers before other references
+	}
+	for _, c := range cases {
+		got := compareCitations(citation(c.a), citation(c.b))
+		if (got < 0) != (c.sign < 0) || (got > 0) != (c.sign > 0) {
+			t.Errorf("compareCitations(%s, %s) = %d, want sign %d", c.a, c.b, got, c.sign)
+		}
+	}
+}
+
+func TestContains(t *testing.T) {
+	cases := []struct {
+		outer, inner string
+		want         bool
+	}{
+		{"urn:cts:greekLit:tlg0001.tlg001:1", "urn:cts:greekLit:tlg0001.tlg001.perseus-grc1:1.5", true},
+		{"urn:cts:greekLit:tlg0001.tlg001:1.1-1.2", "urn:cts:greekLit:tlg0001.tlg001:1.2.5", true},
+		{"urn:cts:greekLit:tlg0001.tlg001:1.1-1.2", "urn:cts:greekLit:tlg0001.tlg001:1.3", false},
+		{"urn:cts:greekLit:tlg0001.tlg001", "urn:cts:greekLit:tlg0001.tlg001:9.9", true},
+		{"urn:cts:greekLit:tlg0001.tlg001", "urn:cts:greekLit:tlg0001.tlg002:1.1", false},
+		{"urn:cts:greekLit:tlg0001.tlg001.perseus-grc1:1", "urn:cts:greekLit:tlg0001.tlg001.other:1.1", false},
+	}
+	for _, c := range cases {
+		outer, _ := parseURN(c.outer)
+		inner, _ := parseURN(c.inner)
+		if got := outer.contains(inner); got != c.want {
+			t.Errorf("%s contains %s = %v, want %v", c.outer, c.inner, got, c.want)
+		}
+	}
+}
+
+func TestSortByCitation(t *testing.T) {
+	ids := []string{
+		"plain-id",
+		"urn:cts:greekLit:tlg0001.tlg001:2.1",
+		"urn:cts:greekLit:tlg0001.tlg001:1.10",
+		"urn:cts:greekLit:tlg0001.tlg002:1.1",
+		"urn:cts:greekLit:tlg0001.tlg001:1.2",
+	}
+	sortByCitation(ids)
+	want := []string{
+		"urn:cts:greekLit:tlg0001.tlg001:1.2",
+		"urn:cts:greekLit:tlg0001.tlg001:1.10",
+		"urn:cts:greekLit:tlg0001.tlg001:2.1",
+		"urn:cts:greekLit:tlg0001.tlg002:1.1",
+		"plain-id",
+	}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("got %v, want %v", ids, want)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Validation policies for rows that fail the ingest checks.
+const (
+	policySkip        = "skip"
+	policyRenormalize = "renormalize"
+	policyAbort       = "abort"
+)
+
+// Kinds of ingest problems.
+const (
+	issueRagged        = "ragged"
+	issueUnparseable   = "unparseable"
+	issueNegative      = "negative"
+	issueNotNormalized = "not_normalized"
+	issueDuplicate     = "duplicate"
+)
+
+type ingestIssue struct {
+	Line   int    `json:"line"`
+	ID     string `json:"id"`
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+	Action string `json:"action"`
+}
+
+// ingestReport summarizes what validation found while reading a theta
+// source. It is printed after loading and written as JSON.
+type ingestReport struct {
+	Model    string         `json:"model"`
+	Source   string         `json:"source"`
+	Policy   string         `json:"policy"`
+	Rows     int            `json:"rows"`
+	Accepted int            `json:"accepted"`
+	Repaired int            `json:"repaired"`
+	Skipped  int            `json:"skipped"`
+	Counts   map[string]int `json:"counts"`
+	Issues   []ingestIssue  `json:"issues"`
+}
+
+// validator checks rows as they are read. Ragged rows, unparseable numbers
+// and duplicate IDs can never be repaired and are skipped unless the policy
+// is to abort; negative and non-normalized vectors are fixed under the
+// renormalize policy.
+type validator struct {
+	policy    string
+	tolerance float64
+	topics    int
+	seen      map[string]int
+	report    *ingestReport
+}
+
+func newValidator(conf serverConfig, topics int) (*validator, error) {
+	policy := strings.ToLower(conf.Validation)
+	switch policy {
+	case "":
+		policy = policySkip
+	case policySkip, policyRenormalize, policyAbort:
+	default:
+		return nil, fmt.Errorf("unknown validation policy %q (use skip, renormalize or abort)", conf.Validation)
+	}
+	tolerance := conf.NormTolerance
+	if tolerance <= 0 {
+		tolerance = 0.01
+	}
+	return &validator{
+		policy:    policy,
+		tolerance: tolerance,
+		topics:    topics,
+		seen:      map[string]int{},
+		report:    &ingestReport{Model: conf.Name, Source: conf.Source, Policy: policy, Counts: map[string]int{}},
+	}, nil
+}
+
+// check validates one row. It returns the (possibly repaired) passage and
+// whether to keep it, or an error if the policy is to abort.
+func (v *validator) check(t theta, line int) (theta, bool, error) {
+	v.report.Rows++
+	var fatal, fixable []ingestIssue
+	issue := func(kind, detail string) ingestIssue {
+		return ingestIssue{Line: line, ID: t.ID, Kind: kind, Detail: detail}
+	}
+
+	if first, ok := v.seen[t.ID]; ok {
+		fatal = append(fatal, issue(issueDuplicate, fmt.Sprintf("ID already seen on line %d", first)))
+	}
+	if len(t.Vector) != v.topics {
+		fatal = append(fatal, issue(issueRagged, fmt.Sprintf("%d topic values, expected %d", len(t.Vector), v.topics)))
+	}
+	var sum float64
+	var bad, negative []int
+	for i, value := range t.Vector {
+		switch {
+		case math.IsNaN(value) || math.IsInf(value, 0):
+			bad = append(bad, i+1)
+		case value < 0:
+			negative = append(negative, i+1)
+		default:
+			sum += value
+		}
+	}
+	if len(bad) > 0 {
+		fatal = append(fatal, issue(issueUnparseable, "no number for topic(s) "+joinInts(bad)))
+	}
+	if len(negative) > 0 {
+		fixable = append(fixable, issue(issueNegative, "negative value for topic(s) "+joinInts(negative)))
+	}
+	if len(bad) == 0 && math.Abs(sum-1) > v.tolerance {
+		detail := fmt.Sprintf("proportions sum to %.6f", sum)
+		if sum == 0 {
+			fatal = append(fatal, issue(issueNotNormalized, detail))
+		} else {
+			fixable = append(fixable, issue(issueNotNormalized, detail))
+		}
+	}
+	if _, ok := v.seen[t.ID]; !ok {
+		v.seen[t.ID] = line
+	}
+
+	if len(fatal) == 0 && len(fixable) == 0 {
+		v.report.Accepted++
+		return t, true, nil
+	}
+	action := "skipped"
+	switch {
+	case v.policy == policyAbort:
+		action = "aborted"
+	case v.policy == policyRenormalize && len(fatal) == 0:
+		action = "renormalized"
+	}
+	for _, i := range append(fatal, fixable...) {
+		i.Action = action
+		v.report.Counts[i.Kind]++
+		v.report.Issues = append(v.report.Issues, i)
+	}
+	switch action {
+	case "aborted":
+		return t, false, fmt.Errorf("line %d (%s): %s", line, t.ID, firstIssue(fatal, fixable).Detail)
+	case "renormalized":
+		v.report.Repaired++
+		v.report.Accepted++
+		return renormalize(t), true, nil
+	}
+	v.report.Skipped++
+	return t, false, nil
+}
+
+func firstIssue(fatal, fixable []ingestIssue) ingestIssue {
+	if len(fatal) > 0 {
+		return fatal[0]
+	}
+	return fixable[0]
+}
+
+// renormalize clamps negative proportions to zero and rescales the vector
+// to sum to one.
+func renormalize(t theta) theta {
+	vector := make([]float64, len(t.Vector))
+	var sum float64
+	for i, value := range t.Vector {
+		vector[i] = math.Max(value, 0)
+		sum += vector[i]
+	}
+	for i := range vector {
+		vector[i] /= sum
+	}
+	t.Vector = vector
+	return t
+}
+
+// addDuplicates records passages the database refused because their ID was
+// stored already.
+func (v *validator) addDuplicates(duplicates []duplicate) {
+	for _, d := range duplicates {
+		v.report.Accepted--
+		v.report.Skipped++
+		v.report.Counts[issueDuplicate]++
+		v.report.Issues = append(v.report.Issues, ingestIssue{Line: d.Line, ID: d.ID, Kind: issueDuplicate, Detail: "work exists already", Action: "skipped"})
+	}
+}
+
+// write prints a summary of the report and saves it in full to
+// processed/ingest_report.json, or ingest_report_<model>.json for models
+// declared by name.
+func (r *ingestReport) write() {
+	log.Printf("Validated %d rows (%s policy): %d accepted, %d repaired, %d skipped.",
+		r.Rows, r.Policy, r.Accepted, r.Repaired, r.Skipped)
+	var kinds []string
+	for kind := range r.Counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		log.Printf("  %s: %d", kind, r.Counts[kind])
+	}
+	for i, issue := range r.Issues {
+		if i == 10 {
+			log.Printf("  ... and %d more", len(r.Issues)-i)
+			break
+		}
+		log.Printf("  line %d (%s): %s, %s [%s]", issue.Line, issue.ID, issue.Kind, issue.Detail, issue.Action)
+	}
+	name := "ingest_report.json"
+	if r.Model != "" && r.Model != defaultModelName {
+		name = "ingest_report_" + r.Model + ".json"
+	}
+	fp := filepath.Join("processed", name)
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(fp, data, 0644)
+	}
+	if err != nil {
+		log.Println("could not write ingest report:", err)
+		return
+	}
+	log.Println("Ingest report written to", fp)
+}
+
+func joinInts(values []int) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprint(v)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func testValidator(t *testing.T, policy string) *validator {
+	v, err := newValidator(serverConfig{Validation: policy}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestValidatorSkip(t *testing.T) {
+	v := testValidator(t, "")
+	rows := []struct {
+		t    theta
+		keep bool
+	}{
+		{theta{ID: "a", Vector: []float64{0.2, 0.3, 0.5}}, true},
+		{theta{ID: "b", Vector: []float64{0.5, 0.5}}, false},             // ragged
+		{theta{ID: "c", Vector: []float64{0.5, math.NaN(), 0.5}}, false}, // unparseable
+		{theta{ID: "d", Vector: []float64{-0.1, 0.6, 0.4}}, false},       // negative
+		{theta{ID: "e", Vector: []float64{0.2, 0.2, 0.2}}, false},        // not normalized
+		{theta{ID: "a", Vector: []float64{0.2, 0.3, 0.5}}, false},        // duplicate
+		{theta{ID: "f", Vector: []float64{0.2, 0.3, 0.495}}, true},       // within tolerance
+	}
+	for i, row := range rows {
+		_, keep, err := v.check(row.t, i+1)
+		if err != nil {
+			t.Fatalf("line %d: %v", i+1, err)
+		}
+		if keep != row.keep {
+			t.Errorf("line %d (%s): keep = %v, want %v", i+1, row.t.ID, keep, row.keep)
+		}
+	}
+	r := v.report
+	if r.Rows != 7 || r.Accepted != 2 || r.Skipped != 5 || r.Repaired != 0 {
+		t.Errorf("report %d rows, %d accepted, %d skipped, %d repaired; want 7, 2, 5, 0", r.Rows, r.Accepted, r.Skipped, r.Repaired)
+	}
+	for _, kind := range []string{issueRagged, issueUnparseable, issueNegative, issueNotNormalized, issueDuplicate} {
+		if r.Counts[kind] != 1 {
+			t.Errorf("%d %s issues, want 1", r.Counts[kind], kind)
+		}
+	}
+}
+
+func TestValidatorRenormalize(t *testing.T) {
+	v := testValidator(t, "renormalize")
+	got, keep, err := v.check(theta{ID: "a", Vector: []float64{-0.2, 0.2, 0.6}}, 1)
+	if err != nil || !keep {
+		t.Fatalf("keep = %v, err = %v; want the row repaired", keep, err)
+	}
+	want := []float64{0, 0.25, 0.75}
+	for i := range want {
+		if math.Abs(got.Vector[i]-want[i]) > 1e-12 {
+			t.Errorf("renormalized to %v, want %v", got.Vector, want)
+			break
+		}
+	}
+	// Rows that cannot be repaired are still skipped.
+	if _, keep, _ := v.check(theta{ID: "b", Vector: []float64{0, 0, 0}}, 2); keep {
+		t.Error("kept a row summing to zero")
+	}
+	if _, keep, _ := v.check(theta{ID: "c", Vector: []float64{1}}, 3); keep {
+		t.Error("kept a ragged row")
+	}
+	if r := v.report; r.Repaired != 1 || r.Accepted != 1 || r.Skipped != 2 {
+		t.Errorf("report %d repaired, %d accepted, %d skipped; want 1, 1, 2", r.Repaired, r.Accepted, r.Skipped)
+	}
+}
+
+func TestValidatorAbort(t *testing.T) {
+	v := testValidator(t, "abort")
+	if _, keep, err := v.check(theta{ID: "a", Vector: []float64{0.2, 0.3, 0.5}}, 1); err != nil || !keep {
+		t.Fatalf("keep = %v, err = %v for a valid row", keep, err)
+	}
+	if _, keep, err := v.check(theta{ID: "b", Vector: []float64{0.5, 0.6, 0.1}}, 2); err == nil || keep {
+		t.Errorf("keep = %v, err = %v; want an error", keep, err)
+	}
+}
+
+func TestValidatorUnknownPolicy(t *testing.T) {
+	if _, err := newValidator(serverConfig{Validation: "ignore"}, 3); err == nil {
+		t.Error("accepted an unknown policy")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// vectorQuery is the body of a POST to /vector/{count}/json. It gives
+// either a full topic vector or a sparse map from topics to weights, where
+// a topic is named by its number (1-based, as in /topic/{topic}), its
+// column header or its label. Weights are normalized to sum to 1 either way.
+type vectorQuery struct {
+	Vector []float64          `json:"vector"`
+	Topics map[string]float64 `json:"topics"`
+}
+
+// maxVectorQuery bounds the size of a vector query body.
+const maxVectorQuery = 1 << 20
+
+// queryVector turns a vector query into a normalized topic vector.
+func (m *model) queryVector(q vectorQuery) ([]float64, error) {
+	topics := m.store.Topics()
+	var vector []float64
+	switch {
+	case q.Vector != nil && q.Topics != nil:
+		return nil, fmt.Errorf("give either vector or topics, not both")
+	case q.Vector != nil:
+		if len(q.Vector) != len(topics) {
+			return nil, fmt.Errorf("vector has %d values, the model has %d topics", len(q.Vector), len(topics))
+		}
+		vector = append([]float64(nil), q.Vector...)
+	case q.Topics != nil:
+		vector = make([]float64, len(topics))
+		for key, weight := range q.Topics {
+			t, err := topicIndex(topics, key)
+			if err != nil {
+				if labeled, lerr := topicIndex(m.topicLabels(), key); lerr == nil {
+					t, err = labeled, nil
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+			vector[t] += weight
+		}
+	default:
+		return nil, fmt.Errorf("give a vector or topics")
+	}
+	var sum float64
+	for _, v := range vector {
+		if v < 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("weights must be non-negative numbers")
+		}
+		sum += v
+	}
+	if sum == 0 {
+		return nil, fmt.Errorf("weights sum to zero")
+	}
+	for i := range vector {
+		vector[i] /= sum
+	}
+	return vector, nil
+}
+
+// topicIndex finds a topic by 1-based number or by label, ignoring case.
+func topicIndex(topics []string, key string) (int, error) {
+	if n, err := strconv.Atoi(key); err == nil {
+		if n < 1 || n > len(topics) {
+			return 0, fmt.Errorf("topic %d out of range 1-%d", n, len(topics))
+		}
+		return n - 1, nil
+	}
+	for i, label := range topics {
+		if strings.EqualFold(label, key) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("no topic %q", key)
+}
+
+// ViewVector finds the passages nearest to a posted topic mixture. It takes
+// the query options of /view/{urn}/{count}/json except work, since the
+// mixture belongs to no work, and answers in the same shape. The mixture
+// itself is not a passage and so is not listed.
+func ViewVector(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	m, release := modelFromRequest(w, r)
+	defer release()
+	if m == nil {
+		return
+	}
+	info, err := infoFromRequest(m, r)
+	if err == nil && info.Scope != "" {
+		err = fmt.Errorf("work does not apply to vector queries")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var q vectorQuery
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxVectorQuery))
+	if err == nil {
+		err = json.Unmarshal(body, &q)
+	}
+	if err != nil {
+		http.Error(w, "reading query: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	vector, err := m.queryVector(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	info.ExcludeSelf = true
+	query := theta{Vector: vector}
+	neighbors, distances := m.searchNear(query, nil, info)
+	resultJSON, _ := json.Marshal(passageResponse(query, neighbors, distances, info))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintln(w, string(resultJSON))
+}
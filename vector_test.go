@@ -0,0 +1,78 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestTopicIndex(t *testing.T) {
+	topics := []string{"Sky", "Sea", "12"}
+	cases := []struct {
+		key     string
+		want    int
+		wantErr bool
+	}{
+		{"1", 0, false},
+		{"3", 2, false},
+		{"sea", 1, false},
+		{"SKY", 0, false},
+		{"12", 0, true}, // numbers are topic numbers, not headers
+		{"0", 0, true},
+		{"4", 0, true},
+		{"-1", 0, true},
+		{"land", 0, true},
+		{"", 0, true},
+	}
+	for _, c := range cases {
+		got, err := topicIndex(topics, c.key)
+		if (err != nil) != c.wantErr || (!c.wantErr && got != c.want) {
+			t.Errorf("topicIndex(%q) = %d, %v; want %d, error %v", c.key, got, err, c.want, c.wantErr)
+		}
+	}
+}
+
+func TestQueryVector(t *testing.T) {
+	m := &model{
+		store:  newMemoryStore(nil, []string{"T1", "T2", "T3"}),
+		labels: &labelStore{labels: map[int]topicLabel{3: {Label: "Ocean"}}},
+	}
+	cases := []struct {
+		name    string
+		query   vectorQuery
+		want    []float64
+		wantErr bool
+	}{
+		{"dense", vectorQuery{Vector: []float64{1, 1, 2}}, []float64{0.25, 0.25, 0.5}, false},
+		{"by number", vectorQuery{Topics: map[string]float64{"1": 3, "3": 1}}, []float64{0.75, 0, 0.25}, false},
+		{"by header and label", vectorQuery{Topics: map[string]float64{"t2": 1, "ocean": 1}}, []float64{0, 0.5, 0.5}, false},
+		{"same topic twice", vectorQuery{Topics: map[string]float64{"2": 1, "T2": 1, "1": 2}}, []float64{0.5, 0.5, 0}, false},
+		{"both", vectorQuery{Vector: []float64{1, 0, 0}, Topics: map[string]float64{"1": 1}}, nil, true},
+		{"neither", vectorQuery{}, nil, true},
+		{"too short", vectorQuery{Vector: []float64{1, 0}}, nil, true},
+		{"too long", vectorQuery{Vector: []float64{1, 0, 0, 0}}, nil, true},
+		{"negative", vectorQuery{Vector: []float64{1, -0.5, 0.5}}, nil, true},
+		{"not a number", vectorQuery{Vector: []float64{1, math.NaN(), 0}}, nil, true},
+		{"infinite", vectorQuery{Topics: map[string]float64{"1": math.Inf(1)}}, nil, true},
+		{"zero", vectorQuery{Vector: []float64{0, 0, 0}}, nil, true},
+		{"empty topics", vectorQuery{Topics: map[string]float64{}}, nil, true},
+		{"unknown topic", vectorQuery{Topics: map[string]float64{"Land": 1}}, nil, true},
+		{"topic out of range", vectorQuery{Topics: map[string]float64{"4": 1}}, nil, true},
+	}
+	for _, c := range cases {
+		got, err := m.queryVector(c.query)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: error %v, want error %v", c.name, err, c.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: %v, want %v", c.name, got, c.want)
+		}
+	}
+	// The posted vector is left as it was.
+	posted := []float64{2, 2, 4}
+	m.queryVector(vectorQuery{Vector: posted})
+	if posted[0] != 2 {
+		t.Errorf("queryVector changed the posted vector to %v", posted)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// topicWords holds what a model knows about the words of its topics, read
+// from the file named by topicWordSource. That is either a MALLET
+// --topic-word-weights-file, which gives the full matrix and allows fold-in
+// inference, or a --output-topic-keys file, which gives each topic's top
+// words and Dirichlet alpha only.
+type topicWords struct {
+	words   []string
+	index   map[string]int
+	weights [][]float64 // weights[w][k], the weight of word w in topic k
+	totals  []float64   // sum of weights per topic
+
+	keys       [][]string  // top words per topic, best first
+	keyWeights [][]float64 // their weights, if known
+	alphas     []float64   // per topic, from a keys file
+}
+
+// maxTopWords is how many top words are kept per topic.
+const maxTopWords = 100
+
+// readTopicWords reads a topic-word file, telling the two formats apart by
+// the third column of the first line: a weight in a weights file
+// ("topic<TAB>word<TAB>weight") and the word list in a keys file
+// ("topic<TAB>alpha<TAB>word word ..."). Topics are numbered from 0.
+func readTopicWords(conf serverConfig, topicCount int) (*topicWords, error) {
+	source, _, err := openResource(conf.TopicWordSource, conf.Local)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+	tw := &topicWords{index: map[string]int{}}
+	scanner := bufio.NewScanner(source)
+	scanner.Buffer(make([]byte, 1<<16), 1<<24)
+	line := 0
+	keysFile := false
+	for scanner.Scan() {
+		line++
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) == 1 && strings.TrimSpace(fields[0]) == "" {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s line %d: expected three tab-separated columns", conf.TopicWordSource, line)
+		}
+		if tw.totals == nil && tw.keys == nil {
+			_, err := strconv.ParseFloat(fields[2], 64)
+			keysFile = err != nil
+			if keysFile {
+				tw.keys = make([][]string, topicCount)
+				tw.alphas = make([]float64, topicCount)
+			} else {
+				tw.totals = make([]float64, topicCount)
+			}
+		}
+		topic, err := strconv.Atoi(fields[0])
+		if err != nil || topic < 0 || topic >= topicCount {
+			return nil, fmt.Errorf("%s line %d: topic %q out of range 0-%d", conf.TopicWordSource, line, fields[0], topicCount-1)
+		}
+		if keysFile {
+			alpha, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: bad alpha %q", conf.TopicWordSource, line, fields[1])
+			}
+			tw.alphas[topic] = alpha
+			tw.keys[topic] = strings.Fields(fields[2])
+			continue
+		}
+		weight, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("%s line %d: bad weight %q", conf.TopicWordSource, line, fields[2])
+		}
+		w := tw.wordIndex(fields[1], topicCount)
+		tw.weights[w][topic] += weight
+		tw.totals[topic] += weight
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if keysFile {
+		log.Printf("Read top words for %d topics from %s.", topicCount, conf.TopicWordSource)
+		return tw, nil
+	}
+	if len(tw.words) == 0 {
+		return nil, fmt.Errorf("%s has no topic words", conf.TopicWordSource)
+	}
+	tw.rankWords(topicCount)
+	log.Printf("Read %d words for %d topics from %s.", len(tw.words), topicCount, conf.TopicWordSource)
+	return tw, nil
+}
+
+func (tw *topicWords) wordIndex(word string, topicCount int) int {
+	w, ok := tw.index[word]
+	if !ok {
+		w = len(tw.words)
+		tw.index[word] = w
+		tw.words = append(tw.words, word)
+		tw.weights = append(tw.weights, make([]float64, topicCount))
+	}
+	return w
+}
+
+// rankWords picks the top words of each topic from the weights, leaving
+// out words of weight zero. MALLET adds its smoothing prior to every
+// word, so with its weights files all words remain candidates.
+func (tw *topicWords) rankWords(topicCount int) {
+	tw.keys = make([][]string, topicCount)
+	tw.keyWeights = make([][]float64, topicCount)
+	for k := 0; k < topicCount; k++ {
+		best := newTopK(maxTopWords, true)
+		for w, word := range tw.words {
+			if tw.weights[w][k] > 0 {
+				best.Offer(theta{ID: word}, tw.weights[w][k])
+			}
+		}
+		words, weights := best.Sorted()
+		for _, word := range words {
+			tw.keys[k] = append(tw.keys[k], word.ID)
+		}
+		tw.keyWeights[k] = weights
+	}
+}
+
+// hasWeights reports whether the full topic-word matrix is known, as
+// fold-in inference needs.
+func (tw *topicWords) hasWeights() bool {
+	return tw.weights != nil
+}
+
+// lookup finds a token in the vocabulary, trying it lowercased if it is
+// not there as it is.
+func (tw *topicWords) lookup(token string) (int, bool) {
+	if w, ok := tw.index[token]; ok {
+		return w, true
+	}
+	w, ok := tw.index[strings.ToLower(token)]
+	return w, ok
+}
+
+// phi is the probability of word w under topic k.
+func (tw *topicWords) phi(w, k int) float64 {
+	if tw.totals[k] == 0 {
+		return 0
+	}
+	return tw.weights[w][k] / tw.totals[k]
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Rules for deriving a work ID from a passage ID (config: workRule).
+const (
+	workRuleCTS    = "cts"    // textgroup and work of a CTS URN
+	workRulePrefix = "prefix" // everything before workPattern
+	workRuleRegex  = "regex"  // first submatch of workPattern
+)
+
+// newWorkRule compiles the work rule of a model configuration. IDs the rule
+// does not apply to form a work of their own.
+func newWorkRule(conf serverConfig) (func(id string) string, error) {
+	switch strings.ToLower(conf.WorkRule) {
+	case "", workRuleCTS:
+		return ctsWork, nil
+	case workRulePrefix:
+		if conf.WorkPattern == "" {
+			return nil, fmt.Errorf("workRule prefix needs a workPattern separator")
+		}
+		return func(id string) string {
+			if i := strings.Index(id, conf.WorkPattern); i > 0 {
+				return id[:i]
+			}
+			return id
+		}, nil
+	case workRuleRegex:
+		re, err := regexp.Compile(conf.WorkPattern)
+		if err != nil {
+			return nil, fmt.Errorf("workPattern: %v", err)
+		}
+		return func(id string) string {
+			match := re.FindStringSubmatch(id)
+			switch {
+			case len(match) > 1:
+				return match[1]
+			case len(match) == 1:
+				return match[0]
+			}
+			return id
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown workRule %q (use cts, prefix or regex)", conf.WorkRule)
+}
+
+// ctsWork cuts urn:cts:greekLit:tlg0001.tlg001.perseus-grc1:1.1 down to
+// urn:cts:greekLit:tlg0001.tlg001.
+func ctsWork(id string) string {
+	u, err := parseURN(id)
+	if err != nil {
+		return id
+	}
+	return u.WorkID()
+}
+
+type workPassage struct {
+	ID       string  `json:"id"`
+	Rank     int     `json:"rank"`
+	Distance float64 `json:"distance"`
+}
+
+type workGroup struct {
+	Work         string        `json:"work"`
+	Count        int           `json:"count"`
+	BestDistance float64       `json:"bestDistance"`
+	BestRank     int           `json:"bestRank"`
+	Passages     []workPassage `json:"passages"`
+}
+
+type workNeighbors struct {
+	URN    string      `json:"urn"`
+	Work   string      `json:"work"`
+	Count  int         `json:"count"`
+	Metric string      `json:"metric"`
+	Works  []workGroup `json:"works"`
+}
+
+// groupByWork groups ranked neighbors by work, best work first.
+func (m *model) groupByWork(thetas []theta, distances []float64) []workGroup {
+	index := map[string]int{}
+	var groups []workGroup
+	for i, t := range thetas {
+		work := m.work(t.ID)
+		g, ok := index[work]
+		if !ok {
+			g = len(groups)
+			index[work] = g
+			groups = append(groups, workGroup{Work: work, BestDistance: distances[i], BestRank: i + 1})
+		}
+		groups[g].Count++
+		groups[g].Passages = append(groups[g].Passages, workPassage{ID: t.ID, Rank: i + 1, Distance: distances[i]})
+	}
+	// Neighbors come sorted, so groups already are in order of their
+	// best passage.
+	return groups
+}
+
+// sortGroupsByCitation puts works, and the passages within each, in
+// citation order instead of by distance.
+func sortGroupsByCitation(groups []workGroup) {
+	keys := map[string]citationKey{}
+	for _, g := range groups {
+		keys[g.Work] = newCitationKey(g.Work)
+		for _, p := range g.Passages {
+			keys[p.ID] = newCitationKey(p.ID)
+		}
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return compareKeys(keys[groups[i].Work], keys[groups[j].Work]) < 0
+	})
+	for _, g := range groups {
+		passages := g.Passages
+		sort.SliceStable(passages, func(i, j int) bool {
+			return compareKeys(keys[passages[i].ID], keys[passages[j].ID]) < 0
+		})
+	}
+}
+
+// ViewWorks returns the neighbors of a passage grouped by work, with how
+// many neighbors each work contributes and its closest one.
+func ViewWorks(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	m, release := modelFromRequest(w, r)
+	defer release()
+	if m == nil {
+		return
+	}
+	info, err := infoFromRequest(m, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, neighbors, nd, err := m.neighborsOf(info.URN, info)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	result := workNeighbors{
+		URN:    info.URN,
+		Work:   m.work(info.URN),
+		Count:  info.Count,
+		Metric: info.Metric.Name(),
+		Works:  m.groupByWork(neighbors, nd),
+	}
+	if info.Order == "citation" {
+		sortGroupsByCitation(result.Works)
+	}
+	resultJSON, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintln(w, string(resultJSON))
+}
+
+// workIDs lists every work with the IDs of its passages, all in citation
+// order.
+func (m *model) workIDs() ([]string, map[string][]string) {
+	members := map[string][]string{}
+	m.store.Vectors(func(id string, vector []float64) error {
+		work := m.work(id)
+		members[work] = append(members[work], id)
+		return nil
+	})
+	works := make([]string, 0, len(members))
+	for work, ids := range members {
+		works = append(works, work)
+		sortByCitation(ids)
+	}
+	sortByCitation(works)
+	return works, members
+}
+
+type workListing struct {
+	Work     string `json:"work"`
+	Passages int    `json:"passages"`
+}
+
+// ListWorks lists the works of a model and their passage counts.
+func ListWorks(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	m, release := modelFromRequest(w, r)
+	defer release()
+	if m == nil {
+		return
+	}
+	works, members := m.workIDs()
+	listing := make([]workListing, len(works))
+	for i, work := range works {
+		listing[i] = workListing{Work: work, Passages: len(members[work])}
+	}
+	resultJSON, _ := json.Marshal(listing)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintln(w, string(resultJSON))
+}
+
+// workMatrix relates every work to every other. For the centroid method,
+// values are distances between the works' mean theta vectors; for links,
+// row i holds the share of work i's passage neighbors found in each work.
+type workMatrix struct {
+	Method   string      `json:"method"`
+	Metric   string      `json:"metric"`
+	Count    int         `json:"count,omitempty"`
+	Works    []string    `json:"works"`
+	Passages []int       `json:"passages"`
+	Values   [][]float64 `json:"values"`
+}
+
+// centroidMatrix averages the theta vectors of each work and compares the
+// averages.
+func (m *model) centroidMatrix(metric DistanceMetric) workMatrix {
+	index := map[string]int{}
+	works, members := m.workIDs()
+	for i, work := range works {
+		index[work] = i
+	}
+	centroids := make([][]float64, len(works))
+	m.store.Vectors(func(id string, vector []float64) error {
+		i := index[m.work(id)]
+		if centroids[i] == nil {
+			centroids[i] = make([]float64, len(vector))
+		}
+		for t, v := range vector {
+			if t < len(centroids[i]) {
+				centroids[i][t] += v
+			}
+		}
+		return nil
+	})
+	result := workMatrix{Method: "centroid", Metric: metric.Name(), Works: works, Passages: make([]int, len(works))}
+	for i, work := range works {
+		result.Passages[i] = len(members[work])
+		for t := range centroids[i] {
+			centroids[i][t] /= float64(len(members[work]))
+		}
+	}
+	result.Values = make([][]float64, len(works))
+	for i := range works {
+		result.Values[i] = make([]float64, len(works))
+		for j := 0; j < i; j++ {
+			d := metric.Distance(centroids[i], centroids[j])
+			result.Values[i][j], result.Values[j][i] = d, d
+		}
+	}
+	return result
+}
+
+// linkMatrix looks up count neighbors for every passage and tallies which
+// works they belong to.
+func (m *model) linkMatrix(ctx context.Context, j *job, metric DistanceMetric, count int, exact bool) (workMatrix, error) {
+	index := map[string]int{}
+	works, members := m.workIDs()
+	var ids []string
+	for i, work := range works {
+		index[work] = i
+		ids = append(ids, members[work]...)
+	}
+	links := make([][]float64, len(works))
+	for i := range links {
+		links[i] = make([]float64, len(works))
+	}
+	var mu sync.Mutex
+	err := parallelEach(ctx, j, ids, func(id string) {
+		query, err := m.store.Get(id)
+		if err != nil {
+			return
+		}
+		neighbors := m.neighborIDs(query, Info{URN: id, Count: count, Metric: metric, Exact: exact})
+		from := index[m.work(id)]
+		mu.Lock()
+		defer mu.Unlock()
+		for _, n := range neighbors {
+			links[from][index[m.work(n)]]++
+		}
+	})
+	if err != nil {
+		return workMatrix{}, err
+	}
+	result := workMatrix{Method: "links", Metric: metric.Name(), Count: count, Works: works, Passages: make([]int, len(works)), Values: links}
+	for i, work := range works {
+		result.Passages[i] = len(members[work])
+		var total float64
+		for _, v := range links[i] {
+			total += v
+		}
+		for k := range links[i] {
+			if total > 0 {
+				links[i][k] = math.Round(links[i][k]/total*1e6) / 1e6
+			}
+		}
+	}
+	return result, nil
+}
+
+// WorkMatrix answers with the centroid matrix right away.
+func WorkMatrix(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	m, release := modelFromRequest(w, r)
+	defer release()
+	if m == nil {
+		return
+	}
+	metric, err := m.metricFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resultJSON, _ := json.Marshal(m.centroidMatrix(metric))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintln(w, string(resultJSON))
+}
+
+// WorkLinkMatrix starts a job building the link matrix, which takes a
+// neighbor query per passage.
+func WorkLinkMatrix(w http.ResponseWriter, r *http.Request) {
+	m, release := modelFromRequest(w, r)
+	if m == nil {
+		return
+	}
+	count, err := strconv.Atoi(mux.Vars(r)["count"])
+	if err != nil || count <= 0 {
+		release()
+		http.Error(w, "count must be a positive number", http.StatusBadRequest)
+		return
+	}
+	metric, err := m.metricFromRequest(r)
+	if err != nil {
+		release()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	exact := r.URL.Query().Get("exact") == "true"
+	j := startJob("work links", m.store.Count(), func(ctx context.Context, j *job) (interface{}, error) {
+		defer release()
+		return m.linkMatrix(ctx, j, metric, count, exact)
+	})
+	writeJobAccepted(w, j)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestNewWorkRule(t *testing.T) {
+	cases := []struct {
+		conf     serverConfig
+		id, want string
+	}{
+		{serverConfig{}, "urn:cts:x:a.b.v1:1.2", "urn:cts:x:a.b"},
+		{serverConfig{WorkRule: "CTS"}, "not-a-urn", "not-a-urn"},
+		{serverConfig{WorkRule: workRulePrefix, WorkPattern: "_"}, "NBhu_12.3", "NBhu"},
+		{serverConfig{WorkRule: workRulePrefix, WorkPattern: "_"}, "_12.3", "_12.3"},
+		{serverConfig{WorkRule: workRuleRegex, WorkPattern: `^(\w+)\d`}, "PVin2.14", "PVin"},
+		{serverConfig{WorkRule: workRuleRegex, WorkPattern: `^[A-Z]+`}, "NBhu12", "NB"},
+		{serverConfig{WorkRule: workRuleRegex, WorkPattern: `^\d`}, "NBhu12", "NBhu12"},
+	}
+	for _, c := range cases {
+		work, err := newWorkRule(c.conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := work(c.id); got != c.want {
+			t.Errorf("%s %q: work of %s = %s, want %s", c.conf.WorkRule, c.conf.WorkPattern, c.id, got, c.want)
+		}
+	}
+	for _, bad := range []serverConfig{
+		{WorkRule: workRulePrefix},
+		{WorkRule: workRuleRegex, WorkPattern: "("},
+		{WorkRule: "author"},
+	} {
+		if _, err := newWorkRule(bad); err == nil {
+			t.Errorf("accepted workRule %q with pattern %q", bad.WorkRule, bad.WorkPattern)
+		}
+	}
+}
+
+// Works come in the order of their best neighbor, and each keeps its
+// passages in rank order.
+func TestGroupByWork(t *testing.T) {
+	m := &model{work: ctsWork}
+	thetas := []theta{
+		{ID: "urn:cts:x:c.d:2.1"},
+		{ID: "urn:cts:x:a.b:1.10"},
+		{ID: "urn:cts:x:c.d:1.2"},
+		{ID: "urn:cts:x:e.f:1.1"},
+		{ID: "urn:cts:x:a.b:1.9"},
+	}
+	distances := []float64{0.1, 0.2, 0.3, 0.4, 0.5}
+	groups := m.groupByWork(thetas, distances)
+	want := []workGroup{
+		{Work: "urn:cts:x:c.d", Count: 2, BestDistance: 0.1, BestRank: 1, Passages: []workPassage{
+			{"urn:cts:x:c.d:2.1", 1, 0.1}, {"urn:cts:x:c.d:1.2", 3, 0.3}}},
+		{Work: "urn:cts:x:a.b", Count: 2, BestDistance: 0.2, BestRank: 2, Passages: []workPassage{
+			{"urn:cts:x:a.b:1.10", 2, 0.2}, {"urn:cts:x:a.b:1.9", 5, 0.5}}},
+		{Work: "urn:cts:x:e.f", Count: 1, BestDistance: 0.4, BestRank: 4, Passages: []workPassage{
+			{"urn:cts:x:e.f:1.1", 4, 0.4}}},
+	}
+	if !reflect.DeepEqual(groups, want) {
+		t.Errorf("groupByWork gave %+v, want %+v", groups, want)
+	}
+
+	sortGroupsByCitation(groups)
+	var order []string
+	for _, g := range groups {
+		for _, p := range g.Passages {
+			order = append(order, p.ID)
+		}
+	}
+	wantOrder := []string{"urn:cts:x:a.b:1.9", "urn:cts:x:a.b:1.10", "urn:cts:x:c.d:1.2", "urn:cts:x:c.d:2.1", "urn:cts:x:e.f:1.1"}
+	if !reflect.DeepEqual(order, wantOrder) {
+		t.Errorf("in citation order: %v, want %v", order, wantOrder)
+	}
+	if groups[0].BestRank != 2 || groups[1].BestRank != 1 {
+		t.Errorf("citation order changed the best ranks: %+v", groups)
+	}
+
+	if groups := m.groupByWork(nil, nil); len(groups) != 0 {
+		t.Errorf("no neighbors gave %+v", groups)
+	}
+}
+
+func TestCentroidMatrix(t *testing.T) {
+	thetas := []theta{
+		{ID: "urn:cts:x:a.b:1.1", Vector: []float64{1, 0}},
+		{ID: "urn:cts:x:a.b:1.2", Vector: []float64{0.5, 0.5}},
+		{ID: "urn:cts:x:c.d:1.1", Vector: []float64{0, 1}},
+	}
+	m := &model{store: newMemoryStore(thetas, []string{"t1", "t2"}), work: ctsWork}
+	matrix := m.centroidMatrix(manhattanMetric{})
+	if !reflect.DeepEqual(matrix.Works, []string{"urn:cts:x:a.b", "urn:cts:x:c.d"}) || !reflect.DeepEqual(matrix.Passages, []int{2, 1}) {
+		t.Fatalf("works %v with %v passages", matrix.Works, matrix.Passages)
+	}
+	// The centroid of a.b is (0.75, 0.25).
+	want := [][]float64{{0, 1.5}, {1.5, 0}}
+	for i := range want {
+		for j := range want[i] {
+			if math.Abs(matrix.Values[i][j]-want[i][j]) > 1e-12 {
+				t.Errorf("values %v, want %v", matrix.Values, want)
+			}
+		}
+	}
+}